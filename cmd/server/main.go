@@ -16,11 +16,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sh3ll3y/promotion-service/internal/api"
 	"github.com/sh3ll3y/promotion-service/internal/config"
+	"github.com/sh3ll3y/promotion-service/internal/csv"
+	"github.com/sh3ll3y/promotion-service/internal/currency"
 	"github.com/sh3ll3y/promotion-service/internal/database"
+	"github.com/sh3ll3y/promotion-service/internal/inbox"
+	"github.com/sh3ll3y/promotion-service/internal/jobs"
 	"github.com/sh3ll3y/promotion-service/internal/kafka"
 	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/money"
 	"github.com/sh3ll3y/promotion-service/internal/repository"
 	"github.com/sh3ll3y/promotion-service/internal/service"
+	"github.com/sh3ll3y/promotion-service/internal/source"
 	"go.uber.org/zap"
 )
 
@@ -47,10 +53,14 @@ func main() {
 	defer readDB.Close()
 
 	// Run migrations
-	if err := database.RunMigrations(writeDB, "./migrations"); err != nil {
+	if err := database.RunMigrations(writeDB, "./migrations", database.VersionTable); err != nil {
 		logging.Logger.Fatal("Failed to run migrations on write database", zap.Error(err))
 	}
-	if err := database.RunMigrations(readDB, "./migrations"); err != nil {
+	if err := database.RunMigrations(readDB, "./migrations", database.VersionTable); err != nil {
+		logging.Logger.Fatal("Failed to run migrations on read database", zap.Error(err))
+	}
+	// Indexes that only serve read queries
+	if err := database.RunMigrations(readDB, "./migrations/read", database.ReadVersionTable); err != nil {
 		logging.Logger.Fatal("Failed to run migrations on read database", zap.Error(err))
 	}
 
@@ -77,21 +87,102 @@ func main() {
 		logging.Logger.Fatal("Failed to create Kafka producer", zap.Error(err))
 	}
 	var eventPublisher types.EventPublisher = kafkaProducer
-	promotionService := service.NewPromotionService(writeRepo, readRepo, eventPublisher)
+	errorPolicy, err := csv.ParseErrorPolicy(cfg.Ingest.ErrorPolicy)
+	if err != nil {
+		logging.Logger.Fatal("Invalid ingest configuration", zap.Error(err))
+	}
+	duplicatePolicy, err := csv.ParseDuplicatePolicy(cfg.Ingest.DuplicatePolicy)
+	if err != nil {
+		logging.Logger.Fatal("Invalid ingest configuration", zap.Error(err))
+	}
+	priceRounding, err := money.ParseRoundingMode(cfg.Ingest.PriceRounding)
+	if err != nil {
+		logging.Logger.Fatal("Invalid ingest configuration", zap.Error(err))
+	}
+	ingestOptions := csv.Options{
+		WorkerCount:        cfg.Ingest.WorkerCount,
+		BatchSize:          cfg.Ingest.BatchSize,
+		FlushInterval:      cfg.Ingest.FlushInterval,
+		ErrorPolicy:        errorPolicy,
+		DuplicatePolicy:    duplicatePolicy,
+		MaxRejectedRows:    cfg.Ingest.MaxRejectedRows,
+		MaxRejectedPercent: cfg.Ingest.MaxRejectedPercent,
+		PriceRounding:      priceRounding,
+		SplitRanges:        cfg.Ingest.SplitRanges,
+		MinSplitSize:       cfg.Ingest.MinSplitSize,
+	}
+	profiles := map[string]csv.Profile{"default": csv.DefaultProfile}
+	for name, profileCfg := range cfg.Ingest.Profiles {
+		var rules []csv.Rule
+		for _, ruleCfg := range profileCfg.Rules {
+			rule, err := csv.NewRule(ruleCfg.Rule, ruleCfg.Value, ruleCfg.Severity)
+			if err != nil {
+				logging.Logger.Fatal("Invalid CSV profile", zap.Error(err), zap.String("profile", name))
+			}
+			rules = append(rules, rule)
+		}
+		profile, err := csv.NewProfile(profileCfg.Header, profileCfg.Delimiter, profileCfg.Quote, profileCfg.Columns, profileCfg.Attributes, profileCfg.DateFormats, profileCfg.Timezone, profileCfg.Currency, rules)
+		if err != nil {
+			logging.Logger.Fatal("Invalid CSV profile", zap.Error(err), zap.String("profile", name))
+		}
+		profiles[name] = profile
+	}
+	if _, ok := profiles[cfg.Ingest.DefaultProfile]; !ok {
+		logging.Logger.Fatal("Default CSV profile is not defined", zap.String("profile", cfg.Ingest.DefaultProfile))
+	}
+	sources := source.NewResolver(cfg.Sources, cfg.S3)
+
+	// background is cancelled on shutdown to stop the consumer, the inbox and
+	// the exchange rate refresh
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	var rates *currency.Table
+	if cfg.Rates.Source != "" {
+		ratesSource, err := sources.Resolve(cfg.Rates.Source)
+		if err != nil {
+			logging.Logger.Fatal("Invalid exchange rates configuration", zap.Error(err))
+		}
+		rates = currency.NewTable(ratesSource, cfg.Rates.RefreshInterval)
+		if err := rates.Start(background); err != nil {
+			logging.Logger.Fatal("Invalid exchange rates configuration", zap.Error(err))
+		}
+	}
+	promotionService := service.NewPromotionService(writeRepo, readRepo, eventPublisher, ingestOptions, profiles, cfg.Ingest.DefaultProfile, sources, rates)
 
-	kafkaConsumer, err := kafka.NewConsumer(cfg.KafkaBrokers, cfg.KafkaTopic, promotionService)
+	jobRepo := repository.NewJobRepository(writeDB)
+	kafkaConsumer, err := kafka.NewConsumer(cfg.KafkaBrokers, cfg.KafkaTopic, promotionService, jobRepo)
 	if err != nil {
 		logging.Logger.Fatal("Failed to create Kafka consumer", zap.Error(err))
 	}
 
 	go func() {
-		if err := kafkaConsumer.Start(); err != nil {
+		if err := kafkaConsumer.Start(background); err != nil {
 			logging.Logger.Error("Kafka consumer error", zap.Error(err))
 		}
 	}()
 
+	jobManager := jobs.NewManager(jobRepo, promotionService, cfg.Ingest.RejectReportDir)
+	if err := jobManager.Start(); err != nil {
+		logging.Logger.Fatal("Failed to start job manager", zap.Error(err))
+	}
+
+	if cfg.Inbox.Enabled {
+		if cfg.Inbox.Profile, err = promotionService.ProfileName(cfg.Inbox.Profile); err != nil {
+			logging.Logger.Fatal("Invalid inbox configuration", zap.Error(err))
+		}
+		mode, err := csv.ParseLoadMode(cfg.Inbox.Mode)
+		if err != nil {
+			logging.Logger.Fatal("Invalid inbox configuration", zap.Error(err))
+		}
+		cfg.Inbox.Mode = string(mode)
+		if err := inbox.NewWatcher(cfg.Inbox, jobManager).Start(background); err != nil {
+			logging.Logger.Fatal("Failed to start inbox watcher", zap.Error(err))
+		}
+	}
+
 	router := mux.NewRouter()
-	api.RegisterHandlers(router, promotionService)
+	api.RegisterHandlers(router, promotionService, jobManager, cfg.Upload)
 	router.Handle("/metrics", promhttp.Handler())
 
 	srv := &http.Server{
@@ -114,7 +205,13 @@ func main() {
 	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		logging.Logger.Fatal("Server forced to shutdown", zap.Error(err))
+		logging.Logger.Error("Server forced to shutdown", zap.Error(err))
+	}
+	stopBackground()
+	// Let the running job finish within the grace period, or interrupt it to
+	// be resumed on the next start
+	if err := jobManager.Shutdown(ctx); err != nil {
+		logging.Logger.Warn("Interrupted running ingestion job", zap.Error(err))
 	}
 
 	logging.Logger.Info("Server exiting")
@@ -134,4 +231,4 @@ func connectWithRetry(dbURL string) (*sql.DB, error) {
 		time.Sleep(5 * time.Second)
 	}
 	return nil, err
-}
\ No newline at end of file
+}
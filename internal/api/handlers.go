@@ -1,52 +1,806 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/gorilla/mux"
+	"github.com/sh3ll3y/promotion-service/internal/config"
+	"github.com/sh3ll3y/promotion-service/internal/csv"
+	"github.com/sh3ll3y/promotion-service/internal/currency"
+	"github.com/sh3ll3y/promotion-service/internal/jobs"
 	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/money"
+	"github.com/sh3ll3y/promotion-service/internal/repository"
 	"github.com/sh3ll3y/promotion-service/internal/service"
 	"go.uber.org/zap"
-	"net/http"
 )
 
-func RegisterHandlers(router *mux.Router, service *service.PromotionService) {
+// defaultMaxErrors is how many errors a validation lists unless the request
+// asks for a different number.
+const defaultMaxErrors = 100
+
+// maxIdempotencyKeyLength limits the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// eventInterval is how often a job event stream reports progress.
+const eventInterval = time.Second
+
+// Page sizes of promotion lists.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// datasetVersionHeader names the dataset a promotion response was served
+// from.
+const datasetVersionHeader = "X-Dataset-Version"
+
+// metadataParam prefixes the query parameters that filter promotion lists by
+// metadata attribute.
+const metadataParam = "metadata."
+
+func RegisterHandlers(router *mux.Router, service *service.PromotionService, jobManager *jobs.Manager, uploadCfg config.UploadConfig) {
+	router.HandleFunc("/promotions", listPromotionsHandler(service)).Methods("GET")
 	router.HandleFunc("/promotions/{id}", getPromotionHandler(service)).Methods("GET")
-	router.HandleFunc("/process-csv", processCSVHandler(service)).Methods("POST")
+	router.HandleFunc("/datasets", listDatasetsHandler(service)).Methods("GET")
+	router.HandleFunc("/datasets/current", getCurrentDatasetHandler(service)).Methods("GET")
+	router.HandleFunc("/process-csv", processCSVHandler(service, jobManager, uploadCfg, false)).Methods("POST")
+	router.HandleFunc("/validate-csv", processCSVHandler(service, jobManager, uploadCfg, true)).Methods("POST")
+	router.HandleFunc("/jobs/{id}", getJobHandler(jobManager)).Methods("GET")
+	router.HandleFunc("/jobs/{id}", cancelJobHandler(jobManager)).Methods("DELETE")
+	router.HandleFunc("/jobs/{id}/rejects", getJobRejectsHandler(jobManager)).Methods("GET")
+	router.HandleFunc("/jobs/{id}/events", getJobEventsHandler(jobManager)).Methods("GET")
+}
+
+// promotionResponse is a promotion with its status, and the conversion that
+// was applied to its price if the request asked for another currency.
+type promotionResponse struct {
+	*models.Promotion
+	Status     models.PromotionStatus `json:"status"`
+	Conversion *conversionResponse    `json:"conversion,omitempty"`
 }
 
+// inactivePromotionResponse is returned for a promotion that is scheduled or
+// expired, unless the request includes inactive promotions. It leaves out
+// the price.
+type inactivePromotionResponse struct {
+	ID             string                 `json:"id"`
+	Status         models.PromotionStatus `json:"status"`
+	StartsAt       *time.Time             `json:"starts_at,omitempty"`
+	ExpirationDate time.Time              `json:"expiration_date"`
+	Error          string                 `json:"error"`
+}
+
+type conversionResponse struct {
+	OriginalPrice    money.Amount `json:"original_price"`
+	OriginalCurrency string       `json:"original_currency"`
+	Rate             money.Amount `json:"rate"`
+	RatesTimestamp   time.Time    `json:"rates_timestamp"`
+}
+
+// getPromotionHandler returns a promotion. A "currency" parameter converts
+// its price into that currency with the current exchange rates.
+//
+// A promotion that has not started yet is answered with 409 Conflict, so
+// clients can tell it from an unknown id, and one that has expired with 410
+// Gone, both with a body that gives its status and dates, unless
+// "include_inactive=true" asks for it regardless.
 func getPromotionHandler(service *service.PromotionService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		promotion, err := service.GetPromotion(id)
+		includeInactive := false
+		if param := r.URL.Query().Get("include_inactive"); param != "" {
+			var err error
+			if includeInactive, err = strconv.ParseBool(param); err != nil {
+				http.Error(w, "Invalid include_inactive parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var target string
+		if param := r.URL.Query().Get("currency"); param != "" {
+			var err error
+			if target, err = currency.ParseCode(param); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		setDatasetVersion(w, r, service)
+		promotion, err := service.GetPromotion(r.Context(), id)
 		if err != nil {
 			logging.Logger.Error("Failed to get promotion", zap.Error(err), zap.String("id", id))
 			http.Error(w, "Promotion not found", http.StatusNotFound)
 			return
 		}
 
+		status := promotion.Status(time.Now())
+		if status != models.StatusActive && !includeInactive {
+			writeInactivePromotion(w, promotion, status)
+			return
+		}
+
+		response := promotionResponse{Promotion: promotion, Status: status}
+		if target != "" && target != promotion.Currency {
+			conversion, err := service.ConvertPrice(promotion, target)
+			if err != nil {
+				switch {
+				case errors.Is(err, currency.ErrNoRates):
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				case errors.Is(err, currency.ErrUnknownRate):
+					http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				default:
+					logging.Logger.Error("Failed to convert promotion price", zap.Error(err), zap.String("id", id))
+					http.Error(w, "Failed to convert price", http.StatusInternalServerError)
+				}
+				return
+			}
+			response.Conversion = &conversionResponse{
+				OriginalPrice:    promotion.Price,
+				OriginalCurrency: promotion.Currency,
+				Rate:             conversion.Rate,
+				RatesTimestamp:   conversion.Timestamp,
+			}
+			converted := *promotion
+			converted.Price, converted.Currency = conversion.Price, target
+			response.Promotion = &converted
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+type promotionListResponse struct {
+	Promotions []promotionResponse `json:"promotions"`
+	// NextAfter is the cursor of the next page, if there may be one
+	NextAfter string `json:"next_after,omitempty"`
+}
+
+// listPromotionsHandler returns the promotions whose metadata has every
+// attribute given as a "metadata.<attribute>=<value>" parameter, in pages of
+// "limit" promotions. The next page starts after the ID in "after". Only
+// active promotions are listed, unless "include_inactive=true".
+func listPromotionsHandler(service *service.PromotionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := repository.PromotionFilter{After: query.Get("after"), Limit: defaultPageSize}
+		for key, values := range query {
+			if attribute := strings.TrimPrefix(key, metadataParam); attribute != key && attribute != "" {
+				if filter.Metadata == nil {
+					filter.Metadata = make(models.Metadata)
+				}
+				filter.Metadata[strings.ToLower(attribute)] = values[0]
+			}
+		}
+		if param := query.Get("include_inactive"); param != "" {
+			var err error
+			if filter.IncludeInactive, err = strconv.ParseBool(param); err != nil {
+				http.Error(w, "Invalid include_inactive parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if param := query.Get("limit"); param != "" {
+			limit, err := strconv.Atoi(param)
+			if err != nil || limit <= 0 || limit > maxPageSize {
+				http.Error(w, fmt.Sprintf("Invalid limit parameter: must be between 1 and %d", maxPageSize), http.StatusBadRequest)
+				return
+			}
+			filter.Limit = limit
+		}
+
+		setDatasetVersion(w, r, service)
+		promotions, err := service.ListPromotions(r.Context(), filter)
+		if err != nil {
+			if errors.Is(err, repository.ErrInvalidCursor) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logging.Logger.Error("Failed to list promotions", zap.Error(err))
+			http.Error(w, "Failed to list promotions", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		response := promotionListResponse{Promotions: make([]promotionResponse, len(promotions))}
+		for i, promotion := range promotions {
+			response.Promotions[i] = promotionResponse{Promotion: promotion, Status: promotion.Status(now)}
+		}
+		if len(promotions) == filter.Limit {
+			response.NextAfter = promotions[len(promotions)-1].ID
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// setDatasetVersion sets the version header of a promotion response, if the
+// version is known.
+func setDatasetVersion(w http.ResponseWriter, r *http.Request, service *service.PromotionService) {
+	if version := service.DatasetVersion(r.Context()); version != "" {
+		w.Header().Set(datasetVersionHeader, version)
+	}
+}
+
+type datasetListResponse struct {
+	Datasets []*models.Dataset `json:"datasets"`
+}
+
+// listDatasetsHandler returns the catalog of datasets, newest first, limited
+// to "limit" datasets and optionally to those with the given "status".
+func listDatasetsHandler(service *service.PromotionService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		status := models.DatasetStatus(query.Get("status"))
+		switch status {
+		case "", models.DatasetLoaded, models.DatasetPublished, models.DatasetSuperseded:
+		default:
+			http.Error(w, "Invalid status parameter", http.StatusBadRequest)
+			return
+		}
+		limit := defaultPageSize
+		if param := query.Get("limit"); param != "" {
+			var err error
+			limit, err = strconv.Atoi(param)
+			if err != nil || limit <= 0 || limit > maxPageSize {
+				http.Error(w, fmt.Sprintf("Invalid limit parameter: must be between 1 and %d", maxPageSize), http.StatusBadRequest)
+				return
+			}
+		}
+
+		datasets, err := service.ListDatasets(r.Context(), status, limit)
+		if err != nil {
+			logging.Logger.Error("Failed to list datasets", zap.Error(err))
+			http.Error(w, "Failed to list datasets", http.StatusInternalServerError)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(promotion)
+		json.NewEncoder(w).Encode(datasetListResponse{Datasets: datasets})
 	}
 }
 
-func processCSVHandler(service *service.PromotionService) http.HandlerFunc {
+// getCurrentDatasetHandler returns the dataset that was published last.
+func getCurrentDatasetHandler(service *service.PromotionService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		filename := r.FormValue("filename")
-		if filename == "" {
-			http.Error(w, "Filename is required", http.StatusBadRequest)
+		dataset, err := service.PublishedDataset(r.Context())
+		if err != nil {
+			logging.Logger.Error("Failed to get published dataset", zap.Error(err))
+			http.Error(w, "Failed to get published dataset", http.StatusInternalServerError)
+			return
+		}
+		if dataset == nil {
+			http.Error(w, "No dataset has been published", http.StatusNotFound)
 			return
 		}
 
-		err := service.ProcessCSVFile(filename)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dataset)
+	}
+}
+
+func writeInactivePromotion(w http.ResponseWriter, promotion *models.Promotion, status models.PromotionStatus) {
+	response := inactivePromotionResponse{
+		ID:             promotion.ID,
+		Status:         status,
+		StartsAt:       promotion.StartsAt,
+		ExpirationDate: promotion.ExpirationDate,
+	}
+	code := http.StatusConflict
+	response.Error = "promotion has not started yet"
+	if status == models.StatusExpired {
+		code = http.StatusGone
+		response.Error = "promotion has expired"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status == models.StatusScheduled && promotion.StartsAt != nil {
+		w.Header().Set("Retry-After", promotion.StartsAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
+
+// processCSVHandler queues a file for ingestion. The CSV profile, the input
+// format and the load mode are taken from the "profile", "format" and "mode"
+// parameters; for uploads they must be in the query string, since the body is
+// the file itself. Without a format parameter the format follows the content
+// type or the file extension, and defaults to CSV.
+//
+// With validate set, or a "dry_run=true" parameter, the file is only parsed
+// and a summary returned; nothing is queued or written. "max_errors" limits
+// the errors listed in the summary.
+//
+// A request with an Idempotency-Key header that repeats an earlier request's
+// key gets the job of the earlier request rather than a new one.
+func processCSVHandler(service *service.PromotionService, jobManager *jobs.Manager, uploadCfg config.UploadConfig, validate bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType := ""
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			var err error
+			mediaType, _, err = mime.ParseMediaType(contentType)
+			if err != nil {
+				http.Error(w, "Invalid Content-Type", http.StatusBadRequest)
+				return
+			}
+		}
+
+		isForm := mediaType == "" || mediaType == "application/x-www-form-urlencoded"
+		if !isForm && mediaType != "multipart/form-data" && !isAllowedContentType(mediaType, uploadCfg) {
+			http.Error(w, "Unsupported Content-Type: "+mediaType, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// Reading the parameters from the form would buffer multipart bodies
+		param := r.URL.Query().Get
+		if isForm {
+			param = r.FormValue
+		}
+		profile, err := service.ProfileName(param("profile"))
 		if err != nil {
-			logging.Logger.Error("Failed to process CSV file", zap.Error(err), zap.String("filename", filename))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var format csv.Format
+		if formatParam := param("format"); formatParam != "" {
+			if format, err = csv.ParseFormat(formatParam); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		mode, err := csv.ParseLoadMode(param("mode"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request := &models.Job{Profile: profile, Format: string(format), Mode: string(mode)}
+		request.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		if len(request.IdempotencyKey) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"message": "CSV processed successfully"})
+		if dryRun := param("dry_run"); dryRun != "" && !validate {
+			if validate, err = strconv.ParseBool(dryRun); err != nil {
+				http.Error(w, "Invalid dry_run parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if validate {
+			maxErrors := defaultMaxErrors
+			if maxErrorsParam := param("max_errors"); maxErrorsParam != "" {
+				if maxErrors, err = strconv.Atoi(maxErrorsParam); err != nil || maxErrors < 1 {
+					http.Error(w, "Invalid max_errors parameter", http.StatusBadRequest)
+					return
+				}
+			}
+			validateCSV(w, r, service, uploadCfg, request, mediaType, isForm, maxErrors)
+			return
+		}
+
+		switch {
+		case isForm:
+			processCSVFilename(w, r, service, jobManager, request)
+		case mediaType == "multipart/form-data":
+			processCSVMultipart(w, r, jobManager, uploadCfg, request)
+		default:
+			request.Format = inferFormat(csv.Format(request.Format), csv.FormatFromContentType(mediaType))
+			processCSVBody(w, r, jobManager, uploadCfg, request)
+		}
+	}
+}
+
+// validateCSV parses a file like processCSVHandler would load it and responds
+// with a summary. Uploads are streamed straight from the request.
+func validateCSV(w http.ResponseWriter, r *http.Request, service *service.PromotionService, uploadCfg config.UploadConfig, request *models.Job, mediaType string, isForm bool, maxErrors int) {
+	var summary *csv.ValidationSummary
+	var err error
+
+	switch {
+	case isForm:
+		if !sourceParam(w, r, service, request) {
+			return
+		}
+		summary, err = service.ValidateFile(r.Context(), request, maxErrors)
+	case mediaType == "multipart/form-data":
+		if !checkUploadSize(w, r, uploadCfg) {
+			return
+		}
+		part, ok := filePart(w, r, uploadCfg)
+		if !ok {
+			return
+		}
+		defer part.Close()
+		request.Format = inferFormat(csv.Format(request.Format), csv.FormatFromContentType(part.Header.Get("Content-Type")), csv.FormatFromFilename(part.FileName()))
+		summary, err = service.ValidateUpload(r.Context(), request, part, part.FileName(), maxErrors)
+	default:
+		compression, encErr := csv.ParseContentEncoding(r.Header.Get("Content-Encoding"))
+		if encErr != nil {
+			http.Error(w, encErr.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if !checkUploadSize(w, r, uploadCfg) {
+			return
+		}
+		request.Format = inferFormat(csv.Format(request.Format), csv.FormatFromContentType(mediaType))
+		summary, err = service.ValidateUpload(r.Context(), request, r.Body, "upload"+compression.Extension(), maxErrors)
+	}
+
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Upload exceeds maximum size", http.StatusRequestEntityTooLarge)
+			return
+		}
+		logging.Logger.Info("File failed validation", zap.Error(err), zap.String("source", request.Source))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
 	}
-}
\ No newline at end of file
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+func processCSVFilename(w http.ResponseWriter, r *http.Request, service *service.PromotionService, jobManager *jobs.Manager, request *models.Job) {
+	if !sourceParam(w, r, service, request) {
+		return
+	}
+	submitJob(w, r, jobManager, request)
+}
+
+// sourceParam sets the source of a request from the "filename" parameter,
+// which is a server-side path or a file://, s3://, http:// or https:// URL,
+// and infers the format from its path. It writes the error response itself
+// if the parameter is missing or invalid.
+func sourceParam(w http.ResponseWriter, r *http.Request, service *service.PromotionService, request *models.Job) bool {
+	filename := r.FormValue("filename")
+	if filename == "" {
+		http.Error(w, "Filename is required", http.StatusBadRequest)
+		return false
+	}
+	src, err := service.Source(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	request.Source = filename
+	request.Format = inferFormat(csv.Format(request.Format), csv.FormatFromFilename(src.Name()))
+	return true
+}
+
+// processCSVBody spools a raw body as is. A compressed body keeps its
+// compression on disk and is decompressed while the job reads it.
+func processCSVBody(w http.ResponseWriter, r *http.Request, jobManager *jobs.Manager, uploadCfg config.UploadConfig, request *models.Job) {
+	compression, err := csv.ParseContentEncoding(r.Header.Get("Content-Encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if !checkUploadSize(w, r, uploadCfg) {
+		return
+	}
+
+	processCSVUpload(w, r, jobManager, uploadCfg, r.Body, compression, request)
+}
+
+// processCSVMultipart streams the "file" part of a multipart request to the
+// spool directory. The parts are read one by one with a MultipartReader rather
+// than ParseMultipartForm, so the upload is never buffered in memory.
+func processCSVMultipart(w http.ResponseWriter, r *http.Request, jobManager *jobs.Manager, uploadCfg config.UploadConfig, request *models.Job) {
+	if !checkUploadSize(w, r, uploadCfg) {
+		return
+	}
+
+	part, ok := filePart(w, r, uploadCfg)
+	if !ok {
+		return
+	}
+	defer part.Close()
+
+	request.Format = inferFormat(csv.Format(request.Format), csv.FormatFromContentType(part.Header.Get("Content-Type")), csv.FormatFromFilename(part.FileName()))
+	processCSVUpload(w, r, jobManager, uploadCfg, part, csv.CompressionFromFilename(part.FileName()), request)
+}
+
+// filePart skips to the "file" part of a multipart request and checks its
+// content type. It writes the error response itself if there is no usable
+// part.
+func filePart(w http.ResponseWriter, r *http.Request, uploadCfg config.UploadConfig) (*multipart.Part, bool) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Multipart field \"file\" is required", http.StatusBadRequest)
+			return nil, false
+		}
+		if err != nil {
+			writeUploadError(w, err)
+			return nil, false
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		partType := part.Header.Get("Content-Type")
+		if partType != "" {
+			mediaType, _, err := mime.ParseMediaType(partType)
+			if err != nil || !isAllowedContentType(mediaType, uploadCfg) {
+				part.Close()
+				http.Error(w, "Unsupported file Content-Type: "+partType, http.StatusUnsupportedMediaType)
+				return nil, false
+			}
+		}
+		return part, true
+	}
+}
+
+// processCSVUpload spools an uploaded body to disk so that the job can read
+// it after the request has completed, then queues the job. The upload is
+// hashed while it is spooled.
+func processCSVUpload(w http.ResponseWriter, r *http.Request, jobManager *jobs.Manager, uploadCfg config.UploadConfig, body io.Reader, compression csv.Compression, request *models.Job) {
+	spool, err := os.CreateTemp(uploadCfg.SpoolDir, "upload-*."+request.Format+compression.Extension())
+	if err != nil {
+		logging.Logger.Error("Failed to create spool file", zap.Error(err))
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(spool, hash), body)
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(spool.Name())
+		logging.Logger.Error("Failed to spool uploaded CSV", zap.Error(err))
+		writeUploadError(w, err)
+		return
+	}
+
+	request.Source = spool.Name()
+	request.Spooled = true
+	request.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	submitJob(w, r, jobManager, request)
+}
+
+type submitResponse struct {
+	JobID     string          `json:"job_id"`
+	State     models.JobState `json:"state"`
+	DatasetID string          `json:"dataset_id,omitempty"`
+	Unchanged bool            `json:"unchanged,omitempty"`
+}
+
+// submitJob queues a job and responds with 202 Accepted, or with 200 OK if
+// the job is already finished because the file is unchanged or the request
+// repeats an idempotency key.
+func submitJob(w http.ResponseWriter, r *http.Request, jobManager *jobs.Manager, request *models.Job) {
+	job, err := jobManager.Submit(r.Context(), request)
+	if err != nil {
+		if request.Spooled {
+			os.Remove(request.Source)
+		}
+		if errors.Is(err, jobs.ErrIdempotencyKeyReused) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		logging.Logger.Error("Failed to queue ingestion job", zap.Error(err), zap.String("source", request.Source))
+		http.Error(w, "Failed to queue ingestion job", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusAccepted
+	if job.Finished() {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(submitResponse{JobID: job.ID, State: job.State, DatasetID: job.DatasetID, Unchanged: job.Unchanged})
+}
+
+type jobResponse struct {
+	*models.Job
+	RejectReportURL string `json:"reject_report_url,omitempty"`
+}
+
+func newJobResponse(job *models.Job) jobResponse {
+	response := jobResponse{Job: job}
+	if job.RejectReport != "" {
+		response.RejectReportURL = "/jobs/" + job.ID + "/rejects"
+	}
+	return response
+}
+
+func getJobHandler(jobManager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := lookupJob(w, r, jobManager)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newJobResponse(job))
+	}
+}
+
+// cancelJobHandler cancels a job. It responds with 200 OK if a queued job was
+// cancelled, or with 202 Accepted while a running job is being rolled back.
+func cancelJobHandler(jobManager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		job, err := jobManager.Cancel(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, repository.ErrJobNotFound):
+				http.Error(w, "Job not found", http.StatusNotFound)
+			case errors.Is(err, jobs.ErrNotCancellable):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				logging.Logger.Error("Failed to cancel job", zap.Error(err), zap.String("id", id))
+				http.Error(w, "Failed to cancel job", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		status := http.StatusAccepted
+		if job.Finished() {
+			status = http.StatusOK
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(newJobResponse(job))
+	}
+}
+
+func getJobRejectsHandler(jobManager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := lookupJob(w, r, jobManager)
+		if !ok {
+			return
+		}
+		if job.RejectReport == "" {
+			http.Error(w, "Job has no rejected rows", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"rejects-"+job.ID+".csv\"")
+		http.ServeFile(w, r, job.RejectReport)
+	}
+}
+
+// getJobEventsHandler streams the progress of a job as Server-Sent Events.
+// A "progress" event is sent every eventInterval until the job finishes; the
+// stream then ends with a "succeeded", "failed" or "cancelled" event carrying
+// the job status.
+func getJobEventsHandler(jobManager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := lookupJob(w, r, jobManager)
+		if !ok {
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ticker := time.NewTicker(eventInterval)
+		defer ticker.Stop()
+		for {
+			if job.Finished() {
+				writeEvent(w, string(job.State), newJobResponse(job))
+				flusher.Flush()
+				return
+			}
+			if err := writeEvent(w, "progress", jobManager.Progress(job)); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+
+			next, err := jobManager.Get(job.ID)
+			if err != nil {
+				logging.Logger.Error("Failed to get job", zap.Error(err), zap.String("id", job.ID))
+				return
+			}
+			job = next
+		}
+	}
+}
+
+func writeEvent(w io.Writer, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+func lookupJob(w http.ResponseWriter, r *http.Request, jobManager *jobs.Manager) (*models.Job, bool) {
+	id := mux.Vars(r)["id"]
+
+	job, err := jobManager.Get(id)
+	if err != nil {
+		if errors.Is(err, repository.ErrJobNotFound) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return nil, false
+		}
+		logging.Logger.Error("Failed to get job", zap.Error(err), zap.String("id", id))
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return nil, false
+	}
+	return job, true
+}
+
+func checkUploadSize(w http.ResponseWriter, r *http.Request, uploadCfg config.UploadConfig) bool {
+	if uploadCfg.MaxBytes <= 0 {
+		return true
+	}
+	if r.ContentLength > uploadCfg.MaxBytes {
+		http.Error(w, "Upload exceeds maximum size", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadCfg.MaxBytes)
+	return true
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "Upload exceeds maximum size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// inferFormat returns the first format that is set, or CSV if none is.
+func inferFormat(formats ...csv.Format) string {
+	for _, format := range formats {
+		if format != "" {
+			return string(format)
+		}
+	}
+	return string(csv.FormatCSV)
+}
+
+func isAllowedContentType(mediaType string, uploadCfg config.UploadConfig) bool {
+	for _, allowed := range uploadCfg.AllowedContentTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
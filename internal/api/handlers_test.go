@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sh3ll3y/promotion-service/internal/csv"
+	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/repository"
+	"github.com/sh3ll3y/promotion-service/internal/service"
+	"go.uber.org/zap"
+)
+
+// readDB is a read database that holds promotions and no published dataset.
+// It answers the queries of the promotion handlers and nothing else.
+type readDB map[string][]driver.Value
+
+func (db readDB) Connect(context.Context) (driver.Conn, error) { return readConn{db}, nil }
+func (db readDB) Driver() driver.Driver                        { return nil }
+
+type readConn struct{ db readDB }
+
+func (c readConn) Prepare(query string) (driver.Stmt, error) { return readStmt{c.db, query}, nil }
+func (c readConn) Close() error                              { return nil }
+func (c readConn) Begin() (driver.Tx, error)                 { return nil, errors.New("read only") }
+
+type readStmt struct {
+	db    readDB
+	query string
+}
+
+func (s readStmt) Close() error                               { return nil }
+func (s readStmt) NumInput() int                              { return -1 }
+func (s readStmt) Exec([]driver.Value) (driver.Result, error) { return nil, errors.New("read only") }
+
+func (s readStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(s.query, "FROM published_dataset"):
+		return &readRows{columns: []string{"dataset_id", "cache_generation"}}, nil
+	case strings.Contains(s.query, "FROM promotions WHERE id = $1"):
+		rows := &readRows{columns: []string{"id", "price", "currency", "starts_at", "expiration_date", "metadata"}}
+		if row, ok := s.db[args[0].(string)]; ok {
+			rows.rows = [][]driver.Value{row}
+		}
+		return rows, nil
+	}
+	return nil, errors.New("unexpected query: " + s.query)
+}
+
+type readRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *readRows) Columns() []string { return r.columns }
+func (r *readRows) Close() error      { return nil }
+
+func (r *readRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestGetPromotion(t *testing.T) {
+	logging.Logger = zap.NewNop()
+	now := time.Now().UTC().Truncate(time.Second)
+	startsAt := now.Add(48 * time.Hour)
+	db := readDB{
+		"active":    {"active", "1.50", "EUR", nil, now.Add(time.Hour), nil},
+		"scheduled": {"scheduled", "2.50", "EUR", startsAt, now.Add(72 * time.Hour), nil},
+		"expired":   {"expired", "3.50", "EUR", now.Add(-72 * time.Hour), now.Add(-time.Hour), nil},
+	}
+	readRepo := repository.NewReadRepository(sql.OpenDB(db), nil)
+	svc := service.NewPromotionService(nil, readRepo, nil, csv.Options{}, nil, "", nil, nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/promotions/{id}", getPromotionHandler(svc)).Methods("GET")
+
+	tests := []struct {
+		name           string
+		url            string
+		wantCode       int
+		wantStatus     string
+		wantRetryAfter string
+	}{
+		{name: "active", url: "/promotions/active", wantCode: http.StatusOK, wantStatus: "active"},
+		{name: "scheduled", url: "/promotions/scheduled", wantCode: http.StatusConflict, wantStatus: "scheduled", wantRetryAfter: startsAt.Format(http.TimeFormat)},
+		{name: "expired", url: "/promotions/expired", wantCode: http.StatusGone, wantStatus: "expired"},
+		{name: "scheduled included", url: "/promotions/scheduled?include_inactive=true", wantCode: http.StatusOK, wantStatus: "scheduled"},
+		{name: "expired included", url: "/promotions/expired?include_inactive=1", wantCode: http.StatusOK, wantStatus: "expired"},
+		{name: "expired not included", url: "/promotions/expired?include_inactive=false", wantCode: http.StatusGone, wantStatus: "expired"},
+		{name: "active included", url: "/promotions/active?include_inactive=true", wantCode: http.StatusOK, wantStatus: "active"},
+		{name: "invalid include_inactive", url: "/promotions/expired?include_inactive=maybe", wantCode: http.StatusBadRequest},
+		{name: "unknown", url: "/promotions/unknown", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if tt.wantStatus == "" {
+				return
+			}
+			var body struct {
+				Status string          `json:"status"`
+				Price  json.RawMessage `json:"price"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", body.Status, tt.wantStatus)
+			}
+			// Inactive promotions are answered without their price
+			if (body.Price != nil) != (tt.wantCode == http.StatusOK) {
+				t.Errorf("price = %s in a %d response", body.Price, rec.Code)
+			}
+		})
+	}
+}
@@ -1,28 +1,143 @@
 package config
 
 import (
+	"fmt"
 	"github.com/spf13/viper"
+	"os"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	WriteDBURL   string   `mapstructure:"write_db_url"`
-	ReadDBURL    string   `mapstructure:"read_db_url"`
-	RedisURL     string   `mapstructure:"redis_url"`
-	KafkaBrokers []string `mapstructure:"kafka_brokers"`
-	KafkaTopic   string   `mapstructure:"kafka_topic"`
-	Environment  string   `mapstructure:"environment"`
+	WriteDBURL   string        `mapstructure:"write_db_url"`
+	ReadDBURL    string        `mapstructure:"read_db_url"`
+	RedisURL     string        `mapstructure:"redis_url"`
+	KafkaBrokers []string      `mapstructure:"kafka_brokers"`
+	KafkaTopic   string        `mapstructure:"kafka_topic"`
+	Environment  string        `mapstructure:"environment"`
+	Upload       UploadConfig  `mapstructure:"upload"`
+	Ingest       IngestConfig  `mapstructure:"ingest"`
+	Inbox        InboxConfig   `mapstructure:"inbox"`
+	Sources      SourcesConfig `mapstructure:"sources"`
+	S3           S3Config      `mapstructure:"s3"`
+	Rates        RatesConfig   `mapstructure:"rates"`
+}
+
+type IngestConfig struct {
+	WorkerCount        int                      `mapstructure:"worker_count"`
+	BatchSize          int                      `mapstructure:"batch_size"`
+	FlushInterval      time.Duration            `mapstructure:"flush_interval"`
+	ErrorPolicy        string                   `mapstructure:"error_policy"`
+	DuplicatePolicy    string                   `mapstructure:"duplicate_policy"`
+	MaxRejectedRows    int64                    `mapstructure:"max_rejected_rows"`
+	MaxRejectedPercent float64                  `mapstructure:"max_rejected_percent"`
+	PriceRounding      string                   `mapstructure:"price_rounding"`
+	SplitRanges        int                      `mapstructure:"split_ranges"`
+	MinSplitSize       int64                    `mapstructure:"min_split_size"`
+	RejectReportDir    string                   `mapstructure:"reject_report_dir"`
+	DefaultProfile     string                   `mapstructure:"default_profile"`
+	Profiles           map[string]ProfileConfig `mapstructure:"profiles"`
+}
+
+// ProfileConfig describes the layout of a partner's CSV files. Columns maps
+// promotion fields (id, price, expiration_date) to header column names, and
+// Attributes maps metadata attributes to further columns.
+type ProfileConfig struct {
+	Header     string            `mapstructure:"header"`
+	Delimiter  string            `mapstructure:"delimiter"`
+	Quote      string            `mapstructure:"quote"`
+	Columns    map[string]string `mapstructure:"columns"`
+	Attributes map[string]string `mapstructure:"attributes"`
+	// DateFormats are Go time layouts, "unix" or "unix_ms". Dates without an
+	// offset are read in Timezone.
+	DateFormats []string `mapstructure:"date_formats"`
+	Timezone    string   `mapstructure:"timezone"`
+	// Currency is the ISO 4217 code of prices in files without a currency
+	// column.
+	Currency string `mapstructure:"currency"`
+	// Rules add to or replace the default business rules.
+	Rules []RuleConfig `mapstructure:"rules"`
+}
+
+type RuleConfig struct {
+	Rule     string `mapstructure:"rule"`
+	Value    string `mapstructure:"value"`
+	Severity string `mapstructure:"severity"`
+}
+
+// InboxConfig configures the watcher that ingests files dropped into Dir.
+// Ready is "marker" to wait for a "<file>.done" marker, or "stable" to wait
+// until the size of a file has not changed for SettleTime.
+type InboxConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Dir          string        `mapstructure:"dir"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	Ready        string        `mapstructure:"ready"`
+	SettleTime   time.Duration `mapstructure:"settle_time"`
+	Profile      string        `mapstructure:"profile"`
+	Mode         string        `mapstructure:"mode"`
+}
+
+// SourcesConfig restricts the hosts http:// and https:// sources may be
+// fetched from. A host is a name or IP address, or "*.example.com" for every
+// subdomain of example.com; "*" allows any host. Without hosts, http and
+// https sources are not allowed.
+type SourcesConfig struct {
+	AllowedHosts []string `mapstructure:"allowed_hosts"`
+}
+
+// S3Config holds the endpoint and credentials for s3:// sources. Without an
+// endpoint AWS is used; without an access key requests are anonymous.
+type S3Config struct {
+	Endpoint        string `mapstructure:"endpoint"`
+	Region          string `mapstructure:"region"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	PathStyle       bool   `mapstructure:"path_style"`
+}
+
+// RatesConfig points to the exchange rates used to convert prices. Source is
+// a path or URL like an ingestion source; without one prices are not
+// converted.
+type RatesConfig struct {
+	Source          string        `mapstructure:"source"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+type UploadConfig struct {
+	MaxBytes            int64    `mapstructure:"max_bytes"`
+	AllowedContentTypes []string `mapstructure:"allowed_content_types"`
+	SpoolDir            string   `mapstructure:"spool_dir"`
 }
 
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
-	viper.AddConfigPath("/root/")  // for Docker
+	viper.AddConfigPath("/root/") // for Docker
 
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
+	viper.SetDefault("upload.max_bytes", int64(10<<30))
+	viper.SetDefault("upload.allowed_content_types", []string{"text/csv", "application/csv", "application/octet-stream", "text/tab-separated-values", "application/x-ndjson", "application/jsonl", "application/gzip", "application/zstd", "application/x-bzip2"})
+	viper.SetDefault("upload.spool_dir", os.TempDir())
+	viper.SetDefault("ingest.worker_count", 5)
+	viper.SetDefault("ingest.batch_size", 5000)
+	viper.SetDefault("ingest.flush_interval", time.Second)
+	viper.SetDefault("ingest.price_rounding", "half_up")
+	viper.SetDefault("ingest.split_ranges", 1)
+	viper.SetDefault("ingest.min_split_size", 256<<20)
+	viper.SetDefault("ingest.error_policy", "fail_fast")
+	viper.SetDefault("ingest.duplicate_policy", "reject")
+	viper.SetDefault("ingest.reject_report_dir", os.TempDir())
+	viper.SetDefault("ingest.default_profile", "default")
+	viper.SetDefault("inbox.poll_interval", 5*time.Second)
+	viper.SetDefault("inbox.ready", "stable")
+	viper.SetDefault("inbox.settle_time", 10*time.Second)
+	viper.SetDefault("rates.refresh_interval", time.Hour)
+
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, err
 	}
@@ -31,6 +146,9 @@ func Load() (*Config, error) {
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, err
 	}
+	if err := config.Ingest.validate(); err != nil {
+		return nil, err
+	}
 
 	// Override with environment variables if they exist
 	if envWriteDBURL := viper.GetString("WRITE_DB_URL"); envWriteDBURL != "" {
@@ -53,4 +171,21 @@ func Load() (*Config, error) {
 	}
 
 	return &config, nil
-}
\ No newline at end of file
+}
+
+// validate rejects settings a load cannot run with, rather than letting it
+// start no workers or never flush a batch.
+func (c IngestConfig) validate() error {
+	switch {
+	case c.WorkerCount <= 0:
+		return fmt.Errorf("ingest.worker_count must be positive, got %d", c.WorkerCount)
+	case c.BatchSize <= 0:
+		return fmt.Errorf("ingest.batch_size must be positive, got %d", c.BatchSize)
+	case c.SplitRanges <= 0:
+		return fmt.Errorf("ingest.split_ranges must be positive, got %d", c.SplitRanges)
+	}
+	if c.MinSplitSize < 0 {
+		return fmt.Errorf("ingest.min_split_size must not be negative, got %d", c.MinSplitSize)
+	}
+	return nil
+}
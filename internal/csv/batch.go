@@ -0,0 +1,134 @@
+package csv
+
+import (
+	"context"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+// PromotionSink persists a batch of parsed promotions together with the
+// checkpoint reached after it. A batch and its checkpoint are either written
+// completely or not at all. The batch may be empty if only rejected rows were
+// read since the last checkpoint.
+type PromotionSink func(ctx context.Context, batch []*models.PromotionRecord, checkpoint *models.Checkpoint) error
+
+// result is the outcome of a single record: a parsed promotion or a rejected
+// row. seq numbers records in input order.
+type result struct {
+	seq       int64
+	line      int
+	endLine   int
+	end       int64
+	header    []string
+	promotion *models.PromotionRecord
+	raw       string
+	err       error
+	// violations lists the business rules the record broke.
+	violations []*Rule
+}
+
+// batchWriter puts the results back into input order, writes rejected rows to
+// the reject report and hands promotions to the sink once BatchSize
+// promotions are buffered or FlushInterval has passed, whichever comes first.
+// Because results are released in order, every flush can carry a checkpoint
+// that covers exactly the records before it.
+func batchWriter(ctx context.Context, results <-chan result, sink PromotionSink, opts Options, stats *Stats, done <-chan struct{}) error {
+	checkpoint := models.Checkpoint{}
+	if opts.Resume != nil {
+		checkpoint = *opts.Resume
+		checkpoint.RuleViolations = append([]models.RuleViolation(nil), opts.Resume.RuleViolations...)
+	}
+
+	pending := make(map[int64]result)
+	var next int64
+	advanced := false
+	batch := make([]*models.PromotionRecord, 0, opts.BatchSize)
+
+	flush := func() error {
+		if !advanced {
+			return nil
+		}
+		if opts.Rejects != nil {
+			size, err := opts.Rejects.Flush()
+			if err != nil {
+				return err
+			}
+			checkpoint.RejectReportSize = size
+		}
+		checkpoint.RowsWritten += int64(len(batch))
+		cp := checkpoint
+		cp.RuleViolations = append([]models.RuleViolation(nil), checkpoint.RuleViolations...)
+		if err := sink(ctx, batch, &cp); err != nil {
+			return err
+		}
+		stats.RowsWritten.Add(int64(len(batch)))
+		batch = make([]*models.PromotionRecord, 0, opts.BatchSize)
+		advanced = false
+		return nil
+	}
+
+	release := func(r result) error {
+		checkpoint.Offset = r.end
+		checkpoint.Line = r.endLine
+		checkpoint.Header = r.header
+		checkpoint.RowsRead++
+		advanced = true
+		if len(r.violations) > 0 {
+			checkpoint.RuleViolations = countViolations(checkpoint.RuleViolations, r.violations)
+			stats.addRuleViolations(r.violations)
+		}
+
+		if r.promotion == nil {
+			checkpoint.RowsRejected++
+			if opts.onReject != nil {
+				opts.onReject(r.line, r.raw, r.err)
+			}
+			if opts.Rejects != nil {
+				return opts.Rejects.Add(r.line, r.raw, r.err)
+			}
+			return nil
+		}
+		batch = append(batch, r.promotion)
+		if len(batch) >= opts.BatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	var tick <-chan time.Time
+	if opts.FlushInterval > 0 {
+		ticker := time.NewTicker(opts.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				return flush()
+			}
+			pending[r.seq] = r
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				if err := release(r); err != nil {
+					return err
+				}
+			}
+		case <-tick:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package csv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/sh3ll3y/promotion-service/internal/source"
+)
+
+// fingerprintBytes is how much of a file goes into its fingerprint.
+const fingerprintBytes = 1 << 20
+
+// Fingerprint identifies the contents of a file well enough to tell whether a
+// checkpoint taken on it still applies: the file size and a SHA-256 of its
+// first megabyte, plus the version of remote files.
+func Fingerprint(ctx context.Context, src source.Source) (string, error) {
+	info, err := src.Stat(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	file, err := src.Open(ctx, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, fingerprintBytes); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	fingerprint := fmt.Sprintf("%d:%s", info.Size, hex.EncodeToString(hash.Sum(nil)))
+	if info.Version != "" {
+		fingerprint += ":" + info.Version
+	}
+	return fingerprint, nil
+}
+
+// drainChecksum reads what is left of r, which tees into h, and returns the
+// hex-encoded digest of h. The pipeline stops at the last record, so trailing
+// bytes are only hashed here.
+func drainChecksum(ctx context.Context, r io.Reader, h hash.Hash) (string, error) {
+	if _, err := io.Copy(io.Discard, &contextReader{ctx: ctx, r: r}); err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
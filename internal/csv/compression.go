@@ -0,0 +1,116 @@
+package csv
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Compression string
+
+const (
+	NoCompression Compression = ""
+	Gzip          Compression = "gzip"
+	Zstd          Compression = "zstd"
+	Bzip2         Compression = "bzip2"
+)
+
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{Bzip2, []byte("BZh")},
+}
+
+var compressionExtensions = map[string]Compression{
+	".gz":   Gzip,
+	".gzip": Gzip,
+	".zst":  Zstd,
+	".zstd": Zstd,
+	".bz2":  Bzip2,
+}
+
+// ParseContentEncoding maps an HTTP Content-Encoding to a compression.
+func ParseContentEncoding(encoding string) (Compression, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return NoCompression, nil
+	case "gzip", "x-gzip":
+		return Gzip, nil
+	case "zstd":
+		return Zstd, nil
+	case "bzip2", "x-bzip2":
+		return Bzip2, nil
+	}
+	return "", fmt.Errorf("unsupported Content-Encoding %q", encoding)
+}
+
+// CompressionFromFilename returns the compression implied by the extension
+// of name.
+func CompressionFromFilename(name string) Compression {
+	return compressionExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Extension returns the file extension for the compression, including the dot.
+func (c Compression) Extension() string {
+	switch c {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	case Bzip2:
+		return ".bz2"
+	}
+	return ""
+}
+
+// decompress wraps r in a streaming decompressor. The compression is detected
+// from the magic bytes of the input and, failing that, from the extension of
+// name; uncompressed input is returned as is. The compression found is
+// returned along with the reader.
+func decompress(r io.Reader, name string) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(4)
+
+	compression := sniffCompression(head)
+	if compression == NoCompression {
+		compression = CompressionFromFilename(name)
+	}
+
+	switch compression {
+	case Gzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, compression, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		return gz, compression, nil
+	case Zstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, compression, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		return zr.IOReadCloser(), compression, nil
+	case Bzip2:
+		return io.NopCloser(bzip2.NewReader(br)), compression, nil
+	}
+	return io.NopCloser(br), compression, nil
+}
+
+// sniffCompression returns the compression whose magic bytes head starts with.
+func sniffCompression(head []byte) Compression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return NoCompression
+}
@@ -0,0 +1,37 @@
+package csv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date formats for epoch timestamps, which have no Go time layout.
+const (
+	FormatUnix      = "unix"
+	FormatUnixMilli = "unix_ms"
+)
+
+// parseDate parses s with the first of the profile's date formats that
+// matches and normalizes the result to UTC.
+func (p Profile) parseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, format := range p.DateFormats {
+		switch format {
+		case FormatUnix:
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return time.Unix(n, 0).UTC(), nil
+			}
+		case FormatUnixMilli:
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return time.UnixMilli(n).UTC(), nil
+			}
+		default:
+			if t, err := time.ParseInLocation(format, s, p.Location); err == nil {
+				return t.UTC(), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q does not match any accepted format (%s)", s, strings.Join(p.DateFormats, ", "))
+}
@@ -0,0 +1,57 @@
+package csv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	tests := []struct {
+		name     string
+		formats  []string
+		location *time.Location
+		in       string
+		want     time.Time
+		wantErr  bool
+	}{
+		{name: "date", formats: []string{"2006-01-02"}, location: time.UTC, in: "2030-01-02", want: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "surrounding space", formats: []string{"2006-01-02"}, location: time.UTC, in: " 2030-01-02 ", want: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "second layout", formats: []string{"2006-01-02", "02/01/2006"}, location: time.UTC, in: "02/01/2030", want: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+		// Both layouts match, and the first one wins
+		{name: "layout order", formats: []string{"02/01/2006", "01/02/2006"}, location: time.UTC, in: "03/04/2030", want: time.Date(2030, 4, 3, 0, 0, 0, 0, time.UTC)},
+		{name: "layout order reversed", formats: []string{"01/02/2006", "02/01/2006"}, location: time.UTC, in: "03/04/2030", want: time.Date(2030, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{name: "unix", formats: []string{FormatUnix}, location: time.UTC, in: "1893456000", want: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "unix_ms", formats: []string{FormatUnixMilli}, location: time.UTC, in: "1893456000123", want: time.Date(2030, 1, 1, 0, 0, 0, 123e6, time.UTC)},
+		{name: "unix after layout", formats: []string{"2006-01-02", FormatUnix}, location: time.UTC, in: "1893456000", want: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// A numeric layout matches before the timestamp format is tried
+		{name: "layout before unix", formats: []string{"20060102", FormatUnix}, location: time.UTC, in: "20300102", want: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "unix ignores location", formats: []string{FormatUnix}, location: berlin, in: "1893456000", want: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "location in winter", formats: []string{"2006-01-02 15:04"}, location: berlin, in: "2030-01-02 10:00", want: time.Date(2030, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{name: "location in summer", formats: []string{"2006-01-02 15:04"}, location: berlin, in: "2030-07-02 10:00", want: time.Date(2030, 7, 2, 8, 0, 0, 0, time.UTC)},
+		{name: "offset overrides location", formats: []string{time.RFC3339}, location: berlin, in: "2030-07-02T10:00:00-05:00", want: time.Date(2030, 7, 2, 15, 0, 0, 0, time.UTC)},
+		{name: "no match", formats: []string{"2006-01-02", FormatUnix}, location: time.UTC, in: "soon", wantErr: true},
+		{name: "unix is not a date", formats: []string{FormatUnix}, location: time.UTC, in: "2030-01-02", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := Profile{DateFormats: tt.formats, Location: tt.location}
+			got, err := profile.parseDate(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseDate(%q) = %v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDate(%q) error = %v", tt.in, err)
+			}
+			if !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("parseDate(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
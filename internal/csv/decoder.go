@@ -0,0 +1,381 @@
+package csv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+type Format string
+
+const (
+	FormatCSV   Format = "csv"
+	FormatTSV   Format = "tsv"
+	FormatJSONL Format = "jsonl"
+)
+
+// Record is a single record of the input, as split off by a Decoder.
+type Record struct {
+	Line int
+	// Fields holds the fields of delimited formats.
+	Fields []string
+	// Raw is the record as it appeared in the input. Decoders may leave it
+	// empty if Fields is set.
+	Raw string
+	// End is the input offset just past the record and EndLine its last
+	// line; a load resumed from there continues with the next record.
+	End     int64
+	EndLine int
+
+	layout *columnLayout
+	header []string
+}
+
+func (r Record) raw() string {
+	if r.Raw == "" && r.Fields != nil {
+		return rawRecord(r.Fields)
+	}
+	return r.Raw
+}
+
+func (r Record) result(seq int64, promotion *models.PromotionRecord, err error) result {
+	res := result{seq: seq, line: r.Line, endLine: r.EndLine, end: r.End, header: r.header, promotion: promotion}
+	if promotion == nil {
+		res.raw = r.raw()
+		res.err = err
+	}
+	return res
+}
+
+// RecordError reports a record that could not be decoded. Decoding can
+// continue with the next record, so the error policy decides what happens.
+type RecordError struct {
+	Record Record
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Decoder splits an input into records and turns records into promotions.
+// Next is called from a single goroutine; Parse is called concurrently by the
+// workers.
+type Decoder interface {
+	// Next returns the next record, io.EOF at the end of the input, or a
+	// *RecordError for a record that can be skipped. Any other error aborts
+	// the load.
+	Next() (Record, error)
+	Parse(rec Record) (*models.PromotionRecord, error)
+}
+
+var decoders = map[Format]func(r io.Reader, opts Options) (Decoder, error){
+	FormatCSV:   newCSVDecoder,
+	FormatTSV:   newTSVDecoder,
+	FormatJSONL: newJSONLDecoder,
+}
+
+func ParseFormat(s string) (Format, error) {
+	format := Format(strings.ToLower(s))
+	if format == "" {
+		return FormatCSV, nil
+	}
+	if format == "ndjson" {
+		return FormatJSONL, nil
+	}
+	if _, ok := decoders[format]; !ok {
+		return "", fmt.Errorf("unknown input format %q", s)
+	}
+	return format, nil
+}
+
+// FormatFromContentType returns the format implied by a media type, or ""
+// if the media type does not imply one.
+func FormatFromContentType(contentType string) Format {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "text/csv", "application/csv":
+		return FormatCSV
+	case "text/tab-separated-values":
+		return FormatTSV
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return FormatJSONL
+	}
+	return ""
+}
+
+// FormatFromFilename returns the format implied by the extension of name,
+// ignoring a compression extension, or "" if the extension does not imply
+// one.
+func FormatFromFilename(name string) Format {
+	if CompressionFromFilename(name) != NoCompression {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return FormatCSV
+	case ".tsv", ".tab":
+		return FormatTSV
+	case ".jsonl", ".ndjson":
+		return FormatJSONL
+	}
+	return ""
+}
+
+// delimitedDecoder handles the header of delimited formats. Until the header,
+// if any, has been read the column layout is unknown.
+type delimitedDecoder struct {
+	profile Profile
+	mode    LoadMode
+	read    func() (Record, error)
+	layout  *columnLayout
+	header  []string
+}
+
+func newDelimitedDecoder(opts Options, read func() (Record, error)) (*delimitedDecoder, error) {
+	d := &delimitedDecoder{profile: opts.Profile, mode: opts.Mode, read: read}
+	if d.profile.Header == HeaderAbsent {
+		d.layout = positionalLayout(d.mode)
+	}
+	// A resumed load starts past the header, so it comes from the checkpoint
+	if resume := opts.Resume; resume != nil && resume.Offset > 0 && d.layout == nil {
+		if resume.Header == nil {
+			d.layout = positionalLayout(d.mode)
+			return d, nil
+		}
+		layout, err := d.profile.headerLayout(resume.Header, d.mode)
+		if err != nil || layout == nil {
+			return nil, fmt.Errorf("checkpoint header does not match the profile")
+		}
+		d.layout, d.header = layout, resume.Header
+	}
+	return d, nil
+}
+
+func (d *delimitedDecoder) Next() (Record, error) {
+	for {
+		rec, err := d.read()
+		if err == io.EOF {
+			if d.layout == nil && d.profile.Header == HeaderPresent {
+				return Record{}, fmt.Errorf("header is missing")
+			}
+			return Record{}, io.EOF
+		}
+
+		if d.layout == nil {
+			if err != nil {
+				if _, ok := err.(*RecordError); !ok || d.profile.Header == HeaderPresent {
+					return Record{}, fmt.Errorf("error reading header: %w", err)
+				}
+				d.layout = positionalLayout(d.mode)
+				return rec, err
+			}
+			d.layout, err = d.profile.headerLayout(rec.Fields, d.mode)
+			if err != nil {
+				return Record{}, err
+			}
+			if d.layout != nil {
+				d.header = rec.Fields
+				continue
+			}
+			d.layout = positionalLayout(d.mode)
+		}
+
+		rec.layout = d.layout
+		rec.header = d.header
+		return rec, err
+	}
+}
+
+func (d *delimitedDecoder) Parse(rec Record) (*models.PromotionRecord, error) {
+	return d.profile.parsePromotion(rec.Fields, rec.layout)
+}
+
+func newCSVDecoder(r io.Reader, opts Options) (Decoder, error) {
+	profile := opts.Profile
+	reader := profile.newReader(r)
+	// encoding/csv counts from the start of what it reads
+	var baseOffset int64
+	var baseLine int
+	if opts.Resume != nil {
+		baseOffset, baseLine = opts.Resume.Offset, opts.Resume.Line
+	}
+	return newDelimitedDecoder(opts, func() (Record, error) {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return Record{}, err
+		}
+		profile.unquote(fields)
+		end := baseOffset + reader.InputOffset()
+		if err != nil {
+			parseErr, ok := err.(*csv.ParseError)
+			if !ok {
+				return Record{}, fmt.Errorf("error reading CSV: %w", err)
+			}
+			rec := Record{Line: baseLine + parseErr.StartLine, Fields: fields, End: end, EndLine: baseLine + parseErr.Line}
+			return rec, &RecordError{Record: rec, Err: recordParseError(parseErr)}
+		}
+		line, _ := reader.FieldPos(0)
+		last := len(fields) - 1
+		endLine, _ := reader.FieldPos(last)
+		endLine += strings.Count(fields[last], "\n")
+		return Record{Line: baseLine + line, Fields: fields, End: end, EndLine: baseLine + endLine}, nil
+	})
+}
+
+// recordParseError describes a parse error relative to its record, since
+// encoding/csv numbers lines from where it started reading, which is not the
+// start of the file in a resumed load or a split range. The line of the
+// record is reported along with the error.
+func recordParseError(e *csv.ParseError) error {
+	if e.Line > e.StartLine {
+		return fmt.Errorf("parse error on line %d of the record, column %d: %w", e.Line-e.StartLine+1, e.Column, e.Err)
+	}
+	return fmt.Errorf("parse error in column %d: %w", e.Column, e.Err)
+}
+
+// newTSVDecoder reads tab-separated values, which have no quoting: every
+// non-empty line is a record and every tab separates two fields.
+func newTSVDecoder(r io.Reader, opts Options) (Decoder, error) {
+	lines := newLineReader(r, opts.Resume)
+	return newDelimitedDecoder(opts, func() (Record, error) {
+		for {
+			text, line, err := lines.next()
+			if err != nil {
+				return Record{}, err
+			}
+			if text != "" {
+				return Record{Line: line, Fields: strings.Split(text, "\t"), Raw: text, End: lines.offset, EndLine: line}, nil
+			}
+		}
+	})
+}
+
+// jsonlDecoder reads one JSON object per line. The profile's column mapping
+// names the object keys.
+type jsonlDecoder struct {
+	profile Profile
+	layout  *columnLayout
+	// names holds the field or attribute at each position of the layout,
+	// and keys the object key it is read from
+	names []string
+	keys  []string
+	lines *lineReader
+}
+
+func newJSONLDecoder(r io.Reader, opts Options) (Decoder, error) {
+	// Objects are laid out like positional records followed by the currency,
+	// the start date and the attributes
+	layout := *positionalLayout(opts.Mode)
+	layout.currency, layout.startsAt, layout.width = layout.width, layout.width+1, layout.width+2
+	names := make([]string, layout.width)
+	names[layout.id], names[layout.price], names[layout.expirationDate] = FieldID, FieldPrice, FieldExpirationDate
+	names[layout.currency], names[layout.startsAt] = FieldCurrency, FieldStartsAt
+	if layout.operation >= 0 {
+		names[layout.operation] = FieldOperation
+	}
+	keys := make([]string, len(names))
+	for i, field := range names {
+		keys[i] = opts.Profile.Columns[field]
+	}
+	for _, attribute := range opts.Profile.attributeNames() {
+		layout.attributes = append(layout.attributes, attributeColumn{name: attribute, index: layout.width})
+		layout.width++
+		names = append(names, attribute)
+		keys = append(keys, opts.Profile.Attributes[attribute])
+	}
+	return &jsonlDecoder{profile: opts.Profile, layout: &layout, names: names, keys: keys, lines: newLineReader(r, opts.Resume)}, nil
+}
+
+func (d *jsonlDecoder) Next() (Record, error) {
+	for {
+		text, line, err := d.lines.next()
+		if err != nil {
+			return Record{}, err
+		}
+		if strings.TrimSpace(text) != "" {
+			return Record{Line: line, Raw: text, End: d.lines.offset, EndLine: line}, nil
+		}
+	}
+}
+
+func (d *jsonlDecoder) Parse(rec Record) (*models.PromotionRecord, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(rec.Raw), &object); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	// Lay the values out like a positional record. Everything but the id and
+	// the operation may be missing, since deletes do not need it.
+	fields := make([]string, d.layout.width)
+	for i := range fields {
+		field, key := d.names[i], d.keys[i]
+		value, ok := object[key]
+		if !ok || string(value) == "null" {
+			if field == FieldID || field == FieldOperation {
+				return nil, fmt.Errorf("missing key %q for %s", key, field)
+			}
+			continue
+		}
+		// Strings are unquoted, anything else is kept as written
+		if len(value) > 0 && value[0] == '"' {
+			if err := json.Unmarshal(value, &fields[i]); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", field, err)
+			}
+		} else {
+			fields[i] = string(value)
+		}
+	}
+	return d.profile.parsePromotion(fields, d.layout)
+}
+
+// lineReader reads lines of any length and counts them, along with the bytes
+// read so far.
+type lineReader struct {
+	r      *bufio.Reader
+	line   int
+	offset int64
+}
+
+func newLineReader(r io.Reader, resume *models.Checkpoint) *lineReader {
+	l := &lineReader{r: bufio.NewReader(r)}
+	if resume != nil {
+		l.line, l.offset = resume.Line, resume.Offset
+	}
+	return l
+}
+
+func (l *lineReader) next() (string, int, error) {
+	b, err := l.r.ReadBytes('\n')
+	if err == io.EOF && len(b) > 0 {
+		err = nil
+	}
+	if err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("error reading input: %w", err)
+		}
+		return "", 0, err
+	}
+	l.line++
+	l.offset += int64(len(b))
+	// Only the start of the input can hold a BOM
+	if l.offset == int64(len(b)) {
+		b = bytes.TrimPrefix(b, []byte("\ufeff"))
+	}
+	return string(bytes.TrimRight(b, "\r\n")), l.line, nil
+}
@@ -0,0 +1,246 @@
+package csv
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+const (
+	id1 = "d018ef0b-dbd9-48f1-ac1a-eb4d90e57118"
+	id2 = "172fb9f4-1a24-4c1d-a6aa-07e0a8f0ec3c"
+)
+
+// decoded is what a test expects of a record: its line and end offset, and
+// either the promotion it parses to or part of its error. Records without an
+// operation are expected to be upserts.
+type decoded struct {
+	line  int
+	end   int64
+	id    string
+	price string
+	op    models.Operation
+	err   string
+}
+
+func decodeAll(t *testing.T, format Format, input string, opts Options) []decoded {
+	t.Helper()
+	dec, err := decoders[format](strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []decoded
+	for {
+		rec, err := dec.Next()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		d := decoded{line: rec.Line, end: rec.End}
+		promotion, err := dec.Parse(rec)
+		if err != nil {
+			d.err = err.Error()
+		} else {
+			d.id, d.price, d.op = promotion.ID, promotion.Price.String(), promotion.Operation
+		}
+		got = append(got, d)
+	}
+}
+
+func checkDecoded(t *testing.T, got, want []decoded) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d records %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if w.err != "" {
+			if !strings.Contains(g.err, w.err) || g.line != w.line {
+				t.Errorf("record %d = %+v, want an error containing %q on line %d", i, g, w.err, w.line)
+			}
+			continue
+		}
+		if w.op == "" {
+			w.op = models.OperationUpsert
+		}
+		if g != w {
+			t.Errorf("record %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestTSVDecoder(t *testing.T) {
+	header := "id\tprice\texpiration_date\n"
+	row1 := id1 + "\t19.99\t2030-01-01\n"
+	row2 := id2 + "\t5\t2030-01-01\r\n"
+	bom := "\ufeff" + header + "\n" + row1 + "\r\n" + strings.TrimSuffix(row2, "\r\n")
+	bad := header + id1 + "\tfree\t2030-01-01\n" + id2 + "\t5\n" + row1
+	deltaHeader := "id\tprice\texpiration_date\toperation\n"
+	upsert := id1 + "\t19.99\t2030-01-01\tupsert\n"
+	remove := id2 + "\t\t\tdelete\n"
+	tests := []struct {
+		name   string
+		input  string
+		mode   LoadMode
+		resume *models.Checkpoint
+		want   []decoded
+	}{
+		{
+			name:  "header",
+			input: header + row1 + row2,
+			want: []decoded{
+				{line: 2, end: int64(len(header + row1)), id: id1, price: "19.99"},
+				{line: 3, end: int64(len(header + row1 + row2)), id: id2, price: "5"},
+			},
+		},
+		{
+			name:  "no header",
+			input: row1 + row2,
+			want: []decoded{
+				{line: 1, end: int64(len(row1)), id: id1, price: "19.99"},
+				{line: 2, end: int64(len(row1 + row2)), id: id2, price: "5"},
+			},
+		},
+		{
+			name:  "bom and blank lines",
+			input: bom,
+			want: []decoded{
+				{line: 3, end: int64(len("\ufeff" + header + "\n" + row1)), id: id1, price: "19.99"},
+				{line: 5, end: int64(len(bom)), id: id2, price: "5"},
+			},
+		},
+		{
+			name:  "bad rows",
+			input: bad,
+			want: []decoded{
+				{line: 2, err: "price"},
+				{line: 3, err: "record length"},
+				{line: 4, end: int64(len(bad)), id: id1, price: "19.99"},
+			},
+		},
+		{
+			name:  "quotes are data",
+			input: header + id1 + "\t\"19.99\"\t2030-01-01\n",
+			want:  []decoded{{line: 2, err: "price"}},
+		},
+		{
+			name:  "delta",
+			input: deltaHeader + upsert + remove,
+			mode:  DeltaLoad,
+			want: []decoded{
+				{line: 2, end: int64(len(deltaHeader + upsert)), id: id1, price: "19.99", op: models.OperationUpsert},
+				{line: 3, end: int64(len(deltaHeader + upsert + remove)), id: id2, price: "0", op: models.OperationDelete},
+			},
+		},
+		{
+			name:   "resume",
+			input:  row2,
+			resume: &models.Checkpoint{Offset: int64(len(header + row1)), Line: 2, Header: strings.Fields(header)},
+			want: []decoded{
+				{line: 3, end: int64(len(header + row1 + row2)), id: id2, price: "5"},
+			},
+		},
+		{
+			name:   "resume without header",
+			input:  row2,
+			resume: &models.Checkpoint{Offset: int64(len(row1)), Line: 1},
+			want: []decoded{
+				{line: 2, end: int64(len(row1 + row2)), id: id2, price: "5"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := DefaultProfile
+			profile.Delimiter = '\t'
+			opts := Options{Profile: profile, Format: FormatTSV, Mode: tt.mode, Resume: tt.resume}
+			if opts.Mode == "" {
+				opts.Mode = FullLoad
+			}
+			checkDecoded(t, decodeAll(t, FormatTSV, tt.input, opts), tt.want)
+		})
+	}
+}
+
+func TestJSONLDecoder(t *testing.T) {
+	line1 := `{"id":"` + id1 + `","price":19.99,"expiration_date":"2030-01-01"}` + "\n"
+	line2 := `{"id":"` + id2 + `","price":"5.00","expiration_date":"2030-01-01","extra":[1]}` + "\r\n"
+	bom := "\ufeff" + line1 + "  \n\n" + strings.TrimSuffix(line2, "\r\n")
+	upsert := `{"id":"` + id1 + `","price":"19.99","expiration_date":"2030-01-01","operation":"upsert"}` + "\n"
+	remove := `{"id":"` + id2 + `","operation":"delete"}` + "\n"
+	bad := "{not json}\n" +
+		`{"price":1,"expiration_date":"2030-01-01"}` + "\n" +
+		`{"id":null,"price":1,"expiration_date":"2030-01-01"}` + "\n" +
+		`{"id":"` + id1 + `","price":true,"expiration_date":"2030-01-01"}` + "\n" +
+		`{"id":"` + id1 + `","price":"1","expiration_date":"soon"}` + "\n" +
+		`{"id":"` + id1 + `","price":"1"}` + "\n" +
+		`{"id":"` + id1 + `","price":"1","expiration_date":1893456000}` + "\n"
+	tests := []struct {
+		name   string
+		input  string
+		mode   LoadMode
+		resume *models.Checkpoint
+		want   []decoded
+	}{
+		{
+			name:  "objects",
+			input: line1 + line2,
+			want: []decoded{
+				{line: 1, end: int64(len(line1)), id: id1, price: "19.99"},
+				{line: 2, end: int64(len(line1 + line2)), id: id2, price: "5"},
+			},
+		},
+		{
+			name:  "bom and blank lines",
+			input: bom,
+			want: []decoded{
+				{line: 1, end: int64(len("\ufeff" + line1)), id: id1, price: "19.99"},
+				{line: 4, end: int64(len(bom)), id: id2, price: "5"},
+			},
+		},
+		{
+			name:  "bad objects",
+			input: bad,
+			want: []decoded{
+				{line: 1, err: "invalid JSON"},
+				{line: 2, err: `missing key "id"`},
+				{line: 3, err: `missing key "id"`},
+				{line: 4, err: "price"},
+				{line: 5, err: "expiration"},
+				{line: 6, err: "expiration"},
+				{line: 7, end: int64(len(bad)), id: id1, price: "1"},
+			},
+		},
+		{
+			name:  "delta",
+			input: upsert + remove + `{"id":"` + id2 + `"}` + "\n",
+			mode:  DeltaLoad,
+			want: []decoded{
+				{line: 1, end: int64(len(upsert)), id: id1, price: "19.99", op: models.OperationUpsert},
+				{line: 2, end: int64(len(upsert + remove)), id: id2, price: "0", op: models.OperationDelete},
+				{line: 3, err: `missing key "operation"`},
+			},
+		},
+		{
+			name:   "resume",
+			input:  line2,
+			resume: &models.Checkpoint{Offset: int64(len(line1)), Line: 1},
+			want: []decoded{
+				{line: 2, end: int64(len(line1 + line2)), id: id2, price: "5"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{Profile: DefaultProfile, Format: FormatJSONL, Mode: tt.mode, Resume: tt.resume}
+			if opts.Mode == "" {
+				opts.Mode = FullLoad
+			}
+			checkDecoded(t, decodeAll(t, FormatJSONL, tt.input, opts), tt.want)
+		})
+	}
+}
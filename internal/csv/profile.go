@@ -0,0 +1,306 @@
+package csv
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sh3ll3y/promotion-service/internal/currency"
+)
+
+var ErrUnknownProfile = errors.New("unknown CSV profile")
+
+type HeaderMode string
+
+const (
+	// HeaderAuto treats the first record as a header if it names every mapped
+	// column, and as data otherwise.
+	HeaderAuto HeaderMode = "auto"
+	// HeaderPresent requires the first record to be a header.
+	HeaderPresent HeaderMode = "present"
+	// HeaderAbsent reads every record as data with positional columns.
+	HeaderAbsent HeaderMode = "absent"
+)
+
+// Promotion fields that can be mapped to a header column. The operation is
+// only read in delta loads. The currency and start date columns are optional.
+const (
+	FieldID             = "id"
+	FieldPrice          = "price"
+	FieldCurrency       = "currency"
+	FieldStartsAt       = "starts_at"
+	FieldExpirationDate = "expiration_date"
+	FieldOperation      = "operation"
+)
+
+// Profile describes the layout of a partner's CSV files. Without a header,
+// records hold the id, price and expiration date in that order, followed by
+// the operation in delta loads; with one, columns are found by name and
+// unknown columns are ignored unless they are mapped to attributes. Prices
+// are in Currency unless a currency column says otherwise.
+type Profile struct {
+	Header    HeaderMode
+	Delimiter rune
+	Quote     byte
+	// Columns maps promotion fields to header column names.
+	Columns map[string]string
+	// Attributes maps metadata attributes to header column names. Records
+	// without a header have no attributes.
+	Attributes map[string]string
+	// DateFormats lists the accepted expiration date formats, tried in
+	// order: Go time layouts, FormatUnix or FormatUnixMilli.
+	DateFormats []string
+	// Location is the time zone of dates whose format has no offset.
+	Location *time.Location
+	// Currency is the ISO 4217 code of prices without a currency of their
+	// own.
+	Currency string
+	// Rules are checked on every parsed promotion.
+	Rules []Rule
+}
+
+var DefaultProfile = Profile{
+	Header:    HeaderAuto,
+	Delimiter: ',',
+	Quote:     '"',
+	Columns: map[string]string{
+		FieldID:             FieldID,
+		FieldPrice:          FieldPrice,
+		FieldCurrency:       FieldCurrency,
+		FieldStartsAt:       FieldStartsAt,
+		FieldExpirationDate: FieldExpirationDate,
+		FieldOperation:      FieldOperation,
+	},
+	DateFormats: []string{"2006-01-02 15:04:05 -0700 MST", time.RFC3339, "2006-01-02", FormatUnix},
+	Location:    time.UTC,
+	Currency:    "EUR",
+	Rules:       DefaultRules,
+}
+
+// NewProfile builds a profile from its configuration. Empty settings and
+// unmapped fields fall back to DefaultProfile. Rules are added to
+// DefaultRules, replacing a default rule of the same name.
+func NewProfile(header, delimiter, quote string, columns, attributes map[string]string, dateFormats []string, timezone, currencyCode string, rules []Rule) (Profile, error) {
+	profile := Profile{
+		Header:      DefaultProfile.Header,
+		Delimiter:   DefaultProfile.Delimiter,
+		Quote:       DefaultProfile.Quote,
+		Columns:     make(map[string]string, len(DefaultProfile.Columns)),
+		DateFormats: DefaultProfile.DateFormats,
+		Location:    DefaultProfile.Location,
+		Currency:    DefaultProfile.Currency,
+	}
+
+	switch mode := HeaderMode(header); mode {
+	case HeaderAuto, HeaderPresent, HeaderAbsent:
+		profile.Header = mode
+	case "":
+	default:
+		return Profile{}, fmt.Errorf("unknown header mode %q", header)
+	}
+
+	if delimiter != "" {
+		r, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) || r == utf8.RuneError || r == '\r' || r == '\n' {
+			return Profile{}, fmt.Errorf("invalid delimiter %q", delimiter)
+		}
+		profile.Delimiter = r
+	}
+
+	if quote != "" {
+		if len(quote) != 1 || quote[0] >= utf8.RuneSelf || quote[0] == '\r' || quote[0] == '\n' {
+			return Profile{}, fmt.Errorf("invalid quote character %q: must be a single ASCII character", quote)
+		}
+		profile.Quote = quote[0]
+	}
+	if profile.Delimiter == rune(profile.Quote) {
+		return Profile{}, fmt.Errorf("delimiter and quote character must differ")
+	}
+
+	for field, column := range DefaultProfile.Columns {
+		profile.Columns[field] = column
+	}
+	for field, column := range columns {
+		if _, ok := DefaultProfile.Columns[field]; !ok {
+			return Profile{}, fmt.Errorf("unknown promotion field %q in column mapping", field)
+		}
+		profile.Columns[field] = column
+	}
+	if len(attributes) > 0 {
+		profile.Attributes = make(map[string]string, len(attributes))
+		for attribute, column := range attributes {
+			attribute = strings.ToLower(strings.TrimSpace(attribute))
+			if attribute == "" || column == "" {
+				return Profile{}, fmt.Errorf("invalid attribute mapping %q to column %q", attribute, column)
+			}
+			profile.Attributes[attribute] = column
+		}
+	}
+
+	if len(dateFormats) > 0 {
+		profile.DateFormats = dateFormats
+	}
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return Profile{}, fmt.Errorf("invalid timezone %q: %w", timezone, err)
+		}
+		profile.Location = location
+	}
+	if currencyCode != "" {
+		code, err := currency.ParseCode(currencyCode)
+		if err != nil {
+			return Profile{}, err
+		}
+		profile.Currency = code
+	}
+	profile.Rules = mergeRules(rules)
+
+	return profile, nil
+}
+
+// newReader returns a CSV reader for r. encoding/csv only understands '"' as
+// the quote character, so any other quote character is swapped with '"' on
+// the way in and restored in the fields by unquote.
+func (p Profile) newReader(r io.Reader) *csv.Reader {
+	if p.Quote != '"' {
+		r = &quoteSwapper{r: r, quote: p.Quote}
+	}
+	reader := csv.NewReader(r)
+	reader.Comma = p.Delimiter
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+func (p Profile) unquote(fields []string) {
+	if p.Quote == '"' {
+		return
+	}
+	swap := func(r rune) rune {
+		switch r {
+		case rune(p.Quote):
+			return '"'
+		case '"':
+			return rune(p.Quote)
+		}
+		return r
+	}
+	for i, field := range fields {
+		fields[i] = strings.Map(swap, field)
+	}
+}
+
+// headerLayout returns the column layout described by a header record. In
+// HeaderAuto mode it returns nil if the record is not a header.
+func (p Profile) headerLayout(fields []string, mode LoadMode) (*columnLayout, error) {
+	positions := make(map[string]int, len(fields))
+	for i, field := range fields {
+		if i == 0 {
+			field = strings.TrimPrefix(field, "\ufeff")
+		}
+		name := strings.ToLower(strings.TrimSpace(field))
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+
+	lookup := func(field string) (int, error) {
+		column := p.Columns[field]
+		i, ok := positions[strings.ToLower(column)]
+		if !ok {
+			return 0, fmt.Errorf("missing column %q for %s in CSV header", column, field)
+		}
+		return i, nil
+	}
+
+	layout := &columnLayout{operation: -1, currency: -1, startsAt: -1, width: len(fields)}
+	var err error
+	if layout.id, err = lookup(FieldID); err == nil {
+		if layout.price, err = lookup(FieldPrice); err == nil {
+			layout.expirationDate, err = lookup(FieldExpirationDate)
+		}
+	}
+	if err == nil && mode == DeltaLoad {
+		layout.operation, err = lookup(FieldOperation)
+	}
+	if i, ok := positions[strings.ToLower(p.Columns[FieldCurrency])]; ok {
+		layout.currency = i
+	}
+	if i, ok := positions[strings.ToLower(p.Columns[FieldStartsAt])]; ok {
+		layout.startsAt = i
+	}
+	for _, attribute := range p.attributeNames() {
+		if i, ok := positions[strings.ToLower(p.Attributes[attribute])]; ok {
+			layout.attributes = append(layout.attributes, attributeColumn{name: attribute, index: i})
+		}
+	}
+	if err != nil {
+		if p.Header == HeaderAuto {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return layout, nil
+}
+
+// columnLayout holds the position of each promotion field in a record and the
+// number of fields a record must have. The operation is -1 in full loads, and
+// the currency and start date -1 if records have none. Attributes are only
+// listed if records have their column.
+type columnLayout struct {
+	id, price, expirationDate, operation, currency, startsAt int
+	attributes                                               []attributeColumn
+	width                                                    int
+}
+
+type attributeColumn struct {
+	name  string
+	index int
+}
+
+// attributeNames returns the names of the mapped attributes in order.
+func (p Profile) attributeNames() []string {
+	names := make([]string, 0, len(p.Attributes))
+	for attribute := range p.Attributes {
+		names = append(names, attribute)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	fullLayout  = &columnLayout{id: 0, price: 1, expirationDate: 2, operation: -1, currency: -1, startsAt: -1, width: 3}
+	deltaLayout = &columnLayout{id: 0, price: 1, expirationDate: 2, operation: 3, currency: -1, startsAt: -1, width: 4}
+)
+
+func positionalLayout(mode LoadMode) *columnLayout {
+	if mode == DeltaLoad {
+		return deltaLayout
+	}
+	return fullLayout
+}
+
+// quoteSwapper exchanges quote with '"' in everything read from r. The swap
+// is its own inverse, so unquote restores the original characters.
+type quoteSwapper struct {
+	r     io.Reader
+	quote byte
+}
+
+func (s *quoteSwapper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	for i := range p[:n] {
+		switch p[i] {
+		case s.quote:
+			p[i] = '"'
+		case '"':
+			p[i] = s.quote
+		}
+	}
+	return n, err
+}
@@ -1,53 +1,254 @@
 package csv
 
 import (
-	"encoding/csv"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/currency"
+	"github.com/sh3ll3y/promotion-service/internal/metrics"
 	"github.com/sh3ll3y/promotion-service/internal/models"
-	"github.com/sh3ll3y/promotion-service/internal/types"
-	"go.uber.org/zap"
+	"github.com/sh3ll3y/promotion-service/internal/money"
+	"github.com/sh3ll3y/promotion-service/internal/source"
 )
 
-type PromotionProcessor func(*models.Promotion) error
+var (
+	ErrInvalidPrice          = errors.New("invalid price")
+	ErrInvalidCurrency       = errors.New("invalid currency")
+	ErrInvalidExpirationDate = errors.New("invalid expiration date")
+	ErrInvalidStartDate      = errors.New("invalid start date")
+)
+
+type LoadMode string
+
+const (
+	// FullLoad replaces the whole dataset with the file.
+	FullLoad LoadMode = "full"
+	// DeltaLoad applies the upserts and deletes in the file to the dataset.
+	DeltaLoad LoadMode = "delta"
+)
+
+func ParseLoadMode(s string) (LoadMode, error) {
+	switch LoadMode(s) {
+	case FullLoad, DeltaLoad:
+		return LoadMode(s), nil
+	case "":
+		return FullLoad, nil
+	}
+	return "", fmt.Errorf("unknown load mode %q", s)
+}
 
-func ProcessPromotionsFromCSV(filename string, processor PromotionProcessor, workerCount int, eventPublisher types.EventPublisher) error {
-	file, err := os.Open(filename)
+type Options struct {
+	WorkerCount        int
+	BatchSize          int
+	FlushInterval      time.Duration
+	ErrorPolicy        ErrorPolicy
+	DuplicatePolicy    models.DuplicatePolicy
+	MaxRejectedRows    int64
+	MaxRejectedPercent float64
+	// PriceRounding rounds prices to models.PriceScale decimal places once
+	// they have passed the business rules; the price range rules are checked
+	// again on the rounded price.
+	PriceRounding money.RoundingMode
+	// SplitRanges is how many byte ranges of a plain file are parsed
+	// concurrently; files smaller than MinSplitSize are read sequentially.
+	SplitRanges  int
+	MinSplitSize int64
+	Profile      Profile
+	Format       Format
+	Mode         LoadMode
+	Rejects      *RejectReport
+	// Resume continues an interrupted load from its last checkpoint.
+	Resume *models.Checkpoint
+
+	// onReject is called for every skipped row, in input order.
+	onReject func(line int, raw string, err error)
+}
+
+// ProcessPromotionsFromCSV streams a source through the pipeline. A resumed
+// load reopens the source at the checkpoint, which for remote sources is a
+// range request. A large plain file is split into byte ranges that are
+// processed concurrently.
+func ProcessPromotionsFromCSV(ctx context.Context, src source.Source, sink PromotionSink, stats *Stats, opts Options) error {
+	// A source that cannot be stat'ed is read like one of unknown size that
+	// cannot be split
+	size, ranges := int64(-1), false
+	if info, err := src.Stat(ctx); err == nil {
+		size, ranges = info.Size, info.Ranges
+	}
+	if size >= 0 {
+		stats.BytesTotal.Store(size)
+	}
+	stats.BytesRead.Store(0)
+	if opts.Resume != nil && len(opts.Resume.Ranges) > 0 {
+		return processSplit(ctx, src, sink, stats, opts, opts.Resume.Ranges)
+	}
+	// The split is planned before the file is opened, so that no stream is
+	// left idle meanwhile. Every range would read the file up to its start
+	// from a source without range requests.
+	if opts.Resume == nil && ranges {
+		ranges, err := splitRanges(ctx, src, size, opts)
+		if err != nil {
+			return err
+		}
+		if ranges != nil {
+			return processSplit(ctx, src, sink, stats, opts, ranges)
+		}
+	}
+
+	file, err := src.Open(ctx, 0)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
+	// The input is hashed as it is read rather than in a pass of its own
+	hash := sha256.New()
+	raw := &countingReader{r: io.TeeReader(file, hash), n: &stats.BytesRead}
+	decompressed, compression, err := decompress(raw, src.Name())
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	var r io.Reader = decompressed
+	if opts.Resume != nil && opts.Resume.Offset > 0 {
+		// Offsets count decompressed bytes, so only plain files can seek. The
+		// stream from the start is closed rather than left idle.
+		if compression == NoCompression {
+			file.Close()
+			rest, err := src.Open(ctx, opts.Resume.Offset)
+			if err != nil {
+				return fmt.Errorf("failed to seek to checkpoint: %w", err)
+			}
+			defer rest.Close()
+			stats.BytesRead.Store(opts.Resume.Offset)
+			r = &countingReader{r: rest, n: &stats.BytesRead}
+		} else if _, err := io.CopyN(io.Discard, &contextReader{ctx: ctx, r: decompressed}, opts.Resume.Offset); err != nil {
+			return fmt.Errorf("failed to skip to checkpoint: %w", err)
+		}
+	}
+
+	if err := ProcessPromotionsFromReader(ctx, r, sink, stats, opts); err != nil {
+		return err
+	}
+	// A resumed load has skipped part of the input, so its hash is unknown
+	if opts.Resume != nil {
+		return nil
+	}
+	checksum, err := drainChecksum(ctx, raw, hash)
+	if err != nil {
+		return err
+	}
+	stats.setChecksum(checksum)
+	return nil
+}
 
-	var wg sync.WaitGroup
-	jobs := make(chan []string)
-	errors := make(chan error, workerCount)
+// ProcessPromotionsFromReader runs the pipeline on a stream. Cancelling ctx
+// stops it like an error would, and returns the error of ctx.
+func ProcessPromotionsFromReader(ctx context.Context, r io.Reader, sink PromotionSink, stats *Stats, opts Options) error {
+	if opts.Resume != nil {
+		stats.RowsRead.Store(opts.Resume.RowsRead)
+		stats.RowsWritten.Store(opts.Resume.RowsWritten)
+		stats.RowsRejected.Store(opts.Resume.RowsRejected)
+		stats.setRuleViolations(opts.Resume.RuleViolations)
+	}
+	if err := processRecords(ctx, r, sink, stats, opts); err != nil {
+		return err
+	}
+	return (&rejecter{opts: opts, stats: stats}).checkBudget()
+}
 
-	for i := 0; i < workerCount; i++ {
-		wg.Add(1)
-		go worker(&wg, jobs, errors, processor)
+// processRecords decodes records on one goroutine, parses them on
+// opts.WorkerCount workers and hands them to a batch writer. Stats are added
+// to, so several streams can share them.
+func processRecords(ctx context.Context, r io.Reader, sink PromotionSink, stats *Stats, opts Options) error {
+	format, err := ParseFormat(string(opts.Format))
+	if err != nil {
+		return err
 	}
+	decoder, err := decoders[format](r, opts)
+	if err != nil {
+		return err
+	}
+	rejecter := &rejecter{opts: opts, stats: stats}
+
+	var wg, producers sync.WaitGroup
+	jobs := make(chan job)
+	results := make(chan result, opts.BatchSize)
+	errors := make(chan error, opts.WorkerCount+2)
+	done := make(chan struct{})
+
+	for i := 0; i < opts.WorkerCount; i++ {
+		producers.Add(1)
+		go worker(&producers, decoder, opts.Profile, opts.PriceRounding, jobs, results, errors, rejecter, done)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		producers.Wait()
+		close(results)
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := batchWriter(ctx, results, sink, opts, stats, done); err != nil {
+			errors <- err
+		}
+	}()
 
+	// The reader must not outlive this call: for uploads r is the request
+	// body, which cannot be read once the handler has returned. Records that
+	// fail to decode skip the workers but still take their turn in the
+	// sequence, so the batch writer can keep the checkpoint in input order.
+	producers.Add(1)
 	go func() {
-		for {
-			record, err := reader.Read()
+		defer producers.Done()
+		defer close(jobs)
+		for seq := int64(0); ; seq++ {
+			if err := ctx.Err(); err != nil {
+				errors <- err
+				return
+			}
+			rec, err := decoder.Next()
 			if err == io.EOF {
-				break
+				return
 			}
 			if err != nil {
-				errors <- fmt.Errorf("error reading CSV: %w", err)
+				recordErr, ok := err.(*RecordError)
+				if !ok {
+					errors <- err
+					return
+				}
+				stats.RowsRead.Add(1)
+				metrics.CsvProcessedLines.Inc()
+				rec = recordErr.Record
+				if err := rejecter.reject(rec.Line, rec.raw(), recordErr.Err); err != nil {
+					errors <- err
+					return
+				}
+				select {
+				case results <- rec.result(seq, nil, recordErr.Err):
+				case <-done:
+					return
+				}
+				continue
+			}
+			stats.RowsRead.Add(1)
+			metrics.CsvProcessedLines.Inc()
+			select {
+			case jobs <- job{seq: seq, rec: rec}:
+			case <-done:
 				return
 			}
-			jobs <- record
 		}
-		close(jobs)
 	}()
 
 	go func() {
@@ -55,57 +256,150 @@ func ProcessPromotionsFromCSV(filename string, processor PromotionProcessor, wor
 		close(errors)
 	}()
 
+	// Drain until every goroutine has exited, stopping the others as soon as
+	// the first error comes in.
+	var processErr error
 	for err := range errors {
-		if err != nil {
-			return err
+		if processErr == nil {
+			processErr = err
+			close(done)
 		}
 	}
+	return processErr
+}
 
-	// Publish event after successful processing
-	err = eventPublisher.PublishNewFileLoadedEvent()
-	if err != nil {
-		logging.Logger.Error("Failed to publish new file loaded event", zap.Error(err))
-		return fmt.Errorf("failed to publish new file loaded event: %w", err)
-	}
-
-	return nil
+// job is a record handed to a worker, numbered in input order.
+type job struct {
+	seq int64
+	rec Record
 }
 
-func worker(wg *sync.WaitGroup, jobs <-chan []string, errors chan<- error, processor PromotionProcessor) {
+// worker parses records, checks the promotions against the business rules of
+// the profile and rounds their prices to the stored precision, checking the
+// range rules again on the rounded price.
+func worker(wg *sync.WaitGroup, decoder Decoder, profile Profile, rounding money.RoundingMode, jobs <-chan job, results chan<- result, errors chan<- error, rejecter *rejecter, done <-chan struct{}) {
 	defer wg.Done()
-	for record := range jobs {
-		promotion, err := parsePromotion(record)
-		if err != nil {
-			errors <- err
-			return
+	for j := range jobs {
+		var violations []*Rule
+		promotion, err := decoder.Parse(j.rec)
+		if err == nil {
+			promotion.Line = j.rec.Line
+			violations, err = profile.checkRules(promotion)
+		}
+		if err == nil {
+			violations, err = profile.roundPrice(promotion, rounding, violations)
 		}
-		err = processor(promotion)
 		if err != nil {
-			errors <- err
+			promotion = nil
+			if err := rejecter.reject(j.rec.Line, j.rec.raw(), err); err != nil {
+				errors <- err
+				return
+			}
+		}
+		res := j.rec.result(j.seq, promotion, err)
+		res.violations = violations
+		select {
+		case results <- res:
+		case <-done:
 			return
 		}
 	}
 }
 
-func parsePromotion(record []string) (*models.Promotion, error) {
-	if len(record) != 3 {
-		return nil, fmt.Errorf("invalid record length: got %d, want 3", len(record))
+func (p Profile) parsePromotion(record []string, layout *columnLayout) (*models.PromotionRecord, error) {
+	if len(record) != layout.width {
+		return nil, fmt.Errorf("invalid record length: got %d, want %d", len(record), layout.width)
 	}
 
-	price, err := strconv.ParseFloat(record[1], 64)
+	promotion := &models.PromotionRecord{Operation: models.OperationUpsert}
+	promotion.ID = record[layout.id]
+	if layout.operation >= 0 {
+		operation, err := parseOperation(record[layout.operation])
+		if err != nil {
+			return nil, err
+		}
+		promotion.Operation = operation
+	}
+	if promotion.Operation == models.OperationDelete {
+		return promotion, nil
+	}
+
+	price, err := money.Parse(record[layout.price])
 	if err != nil {
-		return nil, fmt.Errorf("invalid price: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPrice, err)
 	}
 
-	// Parse the date using the format from your CSV file
-	expirationDate, err := time.Parse("2006-01-02 15:04:05 -0700 MST", record[2])
+	// An empty currency falls back to the profile's
+	promotion.Currency = p.Currency
+	if layout.currency >= 0 && strings.TrimSpace(record[layout.currency]) != "" {
+		if promotion.Currency, err = currency.ParseCode(record[layout.currency]); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidCurrency, err)
+		}
+	}
+
+	expirationDate, err := p.parseDate(record[layout.expirationDate])
 	if err != nil {
-		return nil, fmt.Errorf("invalid expiration date: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidExpirationDate, err)
+	}
+
+	// An empty start date means the promotion starts right away
+	if layout.startsAt >= 0 && strings.TrimSpace(record[layout.startsAt]) != "" {
+		startsAt, err := p.parseDate(record[layout.startsAt])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidStartDate, err)
+		}
+		if !startsAt.Before(expirationDate) {
+			return nil, fmt.Errorf("%w: %s is not before the expiration date %s", ErrInvalidStartDate,
+				startsAt.Format(time.RFC3339), expirationDate.Format(time.RFC3339))
+		}
+		promotion.StartsAt = &startsAt
+	}
+
+	for _, attribute := range layout.attributes {
+		if value := record[attribute.index]; strings.TrimSpace(value) != "" {
+			if promotion.Metadata == nil {
+				promotion.Metadata = make(models.Metadata, len(layout.attributes))
+			}
+			promotion.Metadata[attribute.name] = value
+		}
+	}
+
+	promotion.Price = price
+	promotion.ExpirationDate = expirationDate
+	return promotion, nil
+}
+
+func parseOperation(s string) (models.Operation, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "upsert", "insert", "update":
+		return models.OperationUpsert, nil
+	case "delete":
+		return models.OperationDelete, nil
 	}
+	return "", fmt.Errorf("invalid operation %q: want upsert or delete", s)
+}
+
+// countingReader counts the bytes read from r into n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
 
-	return &models.Promotion{
-		ID:             record[0],
-		Price:          price,
-		ExpirationDate: expirationDate,
-	}, nil
-}
\ No newline at end of file
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,270 @@
+package csv
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+type ErrorPolicy string
+
+const (
+	// FailFast aborts the load on the first rejected row.
+	FailFast ErrorPolicy = "fail_fast"
+	// SkipInvalid skips rejected rows until the error budget is exhausted.
+	SkipInvalid ErrorPolicy = "skip"
+)
+
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch ErrorPolicy(s) {
+	case FailFast, SkipInvalid:
+		return ErrorPolicy(s), nil
+	case "":
+		return FailFast, nil
+	}
+	return "", fmt.Errorf("unknown error policy %q", s)
+}
+
+func ParseDuplicatePolicy(s string) (models.DuplicatePolicy, error) {
+	switch policy := models.DuplicatePolicy(s); policy {
+	case models.DuplicateReject, models.DuplicateFirst, models.DuplicateLast, models.DuplicateLowestPrice:
+		return policy, nil
+	case "":
+		return models.DuplicateReject, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q", s)
+}
+
+// RejectReport records every rejected row as a CSV line of the form
+// line,record,error. It is safe for concurrent use.
+type RejectReport struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	size   *countingWriter
+	writer *csv.Writer
+	rows   int64
+}
+
+func CreateRejectReport(path string) (*RejectReport, error) {
+	return OpenRejectReport(path, 0)
+}
+
+// OpenRejectReport opens the reject report of a resumed job, keeping its
+// first size bytes. A size of 0 starts a new report.
+func OpenRejectReport(path string, size int64) (*RejectReport, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reject report: %w", err)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() < size {
+		file.Close()
+		return nil, fmt.Errorf("reject report is shorter than its checkpoint")
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate reject report: %w", err)
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek reject report: %w", err)
+	}
+
+	counter := &countingWriter{w: file, n: size}
+	writer := csv.NewWriter(counter)
+	if size == 0 {
+		if err := writer.Write([]string{"line", "record", "error"}); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write reject report header: %w", err)
+		}
+	}
+	return &RejectReport{path: path, file: file, size: counter, writer: writer}, nil
+}
+
+func (r *RejectReport) Add(line int, raw string, rejectErr error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rows++
+	return r.writer.Write([]string{strconv.Itoa(line), raw, rejectErr.Error()})
+}
+
+// Rows returns how many rows have been added since the report was opened.
+func (r *RejectReport) Rows() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rows
+}
+
+// Flush writes buffered rows to the file and returns the size of the report.
+func (r *RejectReport) Flush() (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		return 0, fmt.Errorf("failed to write reject report: %w", err)
+	}
+	return r.size.n, nil
+}
+
+func (r *RejectReport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// RemoveRangeReports removes the reject reports that a split load keeps for
+// its ranges next to the report at path.
+func RemoveRangeReports(path string) {
+	matches, _ := filepath.Glob(path + ".range-*")
+	for _, match := range matches {
+		os.Remove(match)
+	}
+}
+
+// appendReport moves the rows of another report to the end of this one,
+// adding lineOffset to their lines, and removes the other report.
+func (r *RejectReport) appendReport(other *RejectReport, lineOffset int) error {
+	if err := other.Close(); err != nil {
+		return fmt.Errorf("failed to write reject report: %w", err)
+	}
+	file, err := os.Open(other.path)
+	if err != nil {
+		return fmt.Errorf("failed to open reject report: %w", err)
+	}
+	defer file.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		return fmt.Errorf("failed to write reject report: %w", err)
+	}
+	// Skip the header of the other report
+	rows := bufio.NewReader(file)
+	if _, err := rows.ReadString('\n'); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read reject report: %w", err)
+	}
+	if lineOffset == 0 {
+		if _, err := io.Copy(r.size, rows); err != nil {
+			return fmt.Errorf("failed to append reject report: %w", err)
+		}
+		return os.Remove(other.path)
+	}
+
+	reader := csv.NewReader(rows)
+	reader.FieldsPerRecord = 3
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read reject report: %w", err)
+		}
+		line, err := strconv.Atoi(row[0])
+		if err != nil {
+			return fmt.Errorf("failed to read reject report: %w", err)
+		}
+		row[0] = strconv.Itoa(line + lineOffset)
+		if err := r.writer.Write(row); err != nil {
+			return fmt.Errorf("failed to append reject report: %w", err)
+		}
+	}
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		return fmt.Errorf("failed to append reject report: %w", err)
+	}
+	return os.Remove(other.path)
+}
+
+// RowError is returned when a rejected row aborts the load, either because the
+// policy is FailFast or because the error budget has run out.
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// rejecter applies the error policy to rejected rows. Skipped rows are
+// written to the reject report in input order by the batch writer; the row
+// that aborts the load is written right away.
+type rejecter struct {
+	opts  Options
+	stats *Stats
+}
+
+func (r *rejecter) reject(line int, raw string, rejectErr error) error {
+	rejected := r.stats.RowsRejected.Add(1)
+
+	var abortErr error
+	if r.opts.ErrorPolicy != SkipInvalid {
+		abortErr = &RowError{Line: line, Err: rejectErr}
+	} else if r.opts.MaxRejectedRows > 0 && rejected > r.opts.MaxRejectedRows {
+		abortErr = &RowError{Line: line, Err: fmt.Errorf("error budget of %d rejected rows exceeded: %w", r.opts.MaxRejectedRows, rejectErr)}
+	}
+
+	if abortErr != nil && r.opts.Rejects != nil {
+		if err := r.opts.Rejects.Add(line, raw, rejectErr); err != nil {
+			return fmt.Errorf("failed to write reject report: %w", err)
+		}
+	}
+	return abortErr
+}
+
+// checkBudget applies the percentage budget, which is only meaningful once
+// the whole file has been read.
+func (r *rejecter) checkBudget() error {
+	if r.opts.ErrorPolicy != SkipInvalid || r.opts.MaxRejectedPercent <= 0 {
+		return nil
+	}
+
+	read := r.stats.RowsRead.Load()
+	rejected := r.stats.RowsRejected.Load()
+	if read == 0 {
+		return nil
+	}
+	if percent := float64(rejected) * 100 / float64(read); percent > r.opts.MaxRejectedPercent {
+		return fmt.Errorf("error budget exceeded: %d of %d rows rejected (%.2f%%, max %.2f%%)",
+			rejected, read, percent, r.opts.MaxRejectedPercent)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func rawRecord(fields []string) string {
+	var sb strings.Builder
+	writer := csv.NewWriter(&sb)
+	writer.Write(fields)
+	writer.Flush()
+	return strings.TrimSuffix(sb.String(), "\n")
+}
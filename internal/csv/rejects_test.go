@@ -0,0 +1,37 @@
+package csv
+
+import (
+	"testing"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    models.DuplicatePolicy
+		wantErr bool
+	}{
+		{in: "", want: models.DuplicateReject},
+		{in: "reject", want: models.DuplicateReject},
+		{in: "first", want: models.DuplicateFirst},
+		{in: "last", want: models.DuplicateLast},
+		{in: "lowest_price", want: models.DuplicateLowestPrice},
+		{in: "Last", wantErr: true},
+		{in: "highest_price", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDuplicatePolicy(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseDuplicatePolicy(%q) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParseDuplicatePolicy(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
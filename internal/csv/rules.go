@@ -0,0 +1,264 @@
+package csv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/money"
+)
+
+var ErrInvalidID = errors.New("invalid id")
+
+type Severity string
+
+const (
+	// SeverityReject rejects the row, subject to the error policy.
+	SeverityReject Severity = "reject"
+	// SeverityWarn loads the row and only counts the violation.
+	SeverityWarn Severity = "warn"
+)
+
+// Rule is a business rule that every parsed promotion is checked against
+// before it is written.
+type Rule struct {
+	Name     string
+	Severity Severity
+	check    func(p *models.PromotionRecord, now time.Time) error
+}
+
+// ruleTypes builds the check of each rule from its configured value. Rules
+// on the price or expiration date do not apply to deletes.
+var ruleTypes = map[string]func(value string) (func(p *models.PromotionRecord, now time.Time) error, error){
+	// uuid_id requires the id to be a UUID in its canonical form.
+	"uuid_id": func(string) (func(*models.PromotionRecord, time.Time) error, error) {
+		return func(p *models.PromotionRecord, _ time.Time) error {
+			if !isUUID(p.ID) {
+				return fmt.Errorf("%w: %q is not a UUID", ErrInvalidID, p.ID)
+			}
+			return nil
+		}, nil
+	},
+	"min_price": func(value string) (func(*models.PromotionRecord, time.Time) error, error) {
+		min, err := money.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minimum price %q", value)
+		}
+		return priceCheck(func(price money.Amount) error {
+			if price.Cmp(min) < 0 {
+				return fmt.Errorf("%w: %s is below the minimum of %s", ErrInvalidPrice, price, min)
+			}
+			return nil
+		}), nil
+	},
+	"max_price": func(value string) (func(*models.PromotionRecord, time.Time) error, error) {
+		max, err := money.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maximum price %q", value)
+		}
+		return priceCheck(func(price money.Amount) error {
+			if price.Cmp(max) > 0 {
+				return fmt.Errorf("%w: %s is above the maximum of %s", ErrInvalidPrice, price, max)
+			}
+			return nil
+		}), nil
+	},
+	// max_decimals limits the decimal places of the price; more are rounded
+	// away by ingest.price_rounding before the price is stored.
+	"max_decimals": func(value string) (func(*models.PromotionRecord, time.Time) error, error) {
+		max, err := strconv.Atoi(value)
+		if err != nil || max < 0 {
+			return nil, fmt.Errorf("invalid number of decimals %q", value)
+		}
+		return priceCheck(func(price money.Amount) error {
+			if price.Decimals() > max {
+				return fmt.Errorf("%w: %s has more than %d decimals", ErrInvalidPrice, price, max)
+			}
+			return nil
+		}), nil
+	},
+	"not_expired": func(string) (func(*models.PromotionRecord, time.Time) error, error) {
+		return func(p *models.PromotionRecord, now time.Time) error {
+			if p.Operation != models.OperationDelete && !p.ExpirationDate.After(now) {
+				return fmt.Errorf("%w: %s has already passed", ErrInvalidExpirationDate, p.ExpirationDate.Format(time.RFC3339))
+			}
+			return nil
+		}, nil
+	},
+	// max_validity limits how far in the future a promotion may expire, as a
+	// Go duration such as "8760h".
+	"max_validity": func(value string) (func(*models.PromotionRecord, time.Time) error, error) {
+		max, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid validity %q: %w", value, err)
+		}
+		return func(p *models.PromotionRecord, now time.Time) error {
+			if p.Operation != models.OperationDelete && p.ExpirationDate.After(now.Add(max)) {
+				return fmt.Errorf("%w: %s is more than %s away", ErrInvalidExpirationDate, p.ExpirationDate.Format(time.RFC3339), max)
+			}
+			return nil
+		}, nil
+	},
+}
+
+// DefaultRules apply to every profile. They keep out what the database
+// cannot store, and warn about promotions that have already expired or whose
+// price would be rounded.
+var DefaultRules = []Rule{
+	mustRule("uuid_id", "", SeverityReject),
+	mustRule("min_price", "0", SeverityReject),
+	mustRule("max_price", "99999999.99", SeverityReject),
+	mustRule("max_decimals", "2", SeverityWarn),
+	mustRule("not_expired", "", SeverityWarn),
+}
+
+// NewRule builds a rule from its configuration. The severity defaults to
+// SeverityReject.
+func NewRule(name, value, severity string) (Rule, error) {
+	build, ok := ruleTypes[name]
+	if !ok {
+		return Rule{}, fmt.Errorf("unknown rule %q", name)
+	}
+
+	rule := Rule{Name: name, Severity: SeverityReject}
+	switch s := Severity(severity); s {
+	case SeverityReject, SeverityWarn:
+		rule.Severity = s
+	case "":
+	default:
+		return Rule{}, fmt.Errorf("unknown severity %q for rule %s", severity, name)
+	}
+
+	check, err := build(value)
+	if err != nil {
+		return Rule{}, fmt.Errorf("rule %s: %w", name, err)
+	}
+	rule.check = check
+	return rule, nil
+}
+
+func mustRule(name, value string, severity Severity) Rule {
+	rule, err := NewRule(name, value, string(severity))
+	if err != nil {
+		panic(err)
+	}
+	return rule
+}
+
+// mergeRules returns the default rules with those of the same name replaced
+// by the profile's, followed by the profile's other rules.
+func mergeRules(rules []Rule) []Rule {
+	merged := make([]Rule, 0, len(DefaultRules)+len(rules))
+	merged = append(merged, DefaultRules...)
+	for _, rule := range rules {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == rule.Name {
+				merged[i], replaced = rule, true
+			}
+		}
+		if !replaced {
+			merged = append(merged, rule)
+		}
+	}
+	return merged
+}
+
+// roundedRules are checked again once the price has been rounded, since
+// rounding may carry it across their bound.
+var roundedRules = map[string]bool{"min_price": true, "max_price": true}
+
+// checkRules checks a promotion against every rule of the profile. It
+// returns the rules that were broken and, if any of them rejects the row, the
+// violation of the first such rule.
+func (p Profile) checkRules(promotion *models.PromotionRecord) ([]*Rule, error) {
+	return p.applyRules(promotion, nil, nil)
+}
+
+// roundPrice rounds the price of a promotion to the stored precision and
+// checks the range rules again on the rounded price: 99999999.995 passes a
+// maximum of 99999999.99 but rounds half up to 100000000.00. Rules that were
+// already broken are not counted twice. A rounded price that the database
+// cannot hold is rejected whatever the rules say.
+func (p Profile) roundPrice(promotion *models.PromotionRecord, mode money.RoundingMode, violated []*Rule) ([]*Rule, error) {
+	if promotion.Operation == models.OperationDelete {
+		return violated, nil
+	}
+	rounded, err := promotion.Price.Round(models.PriceScale, mode)
+	if err != nil {
+		return violated, fmt.Errorf("%w: %w", ErrInvalidPrice, err)
+	}
+	if rounded != promotion.Price {
+		promotion.Price = rounded
+		if violated, err = p.applyRules(promotion, violated, roundedRules); err != nil {
+			return violated, err
+		}
+	}
+	if rounded.Cmp(models.MinPrice) < 0 || rounded.Cmp(models.MaxPrice) > 0 {
+		return violated, fmt.Errorf("%w: %s is outside the stored range of %s to %s", ErrInvalidPrice, rounded, models.MinPrice, models.MaxPrice)
+	}
+	return violated, nil
+}
+
+// applyRules checks a promotion against the rules of the profile, or only
+// those named in only, that are not among the violated ones yet.
+func (p Profile) applyRules(promotion *models.PromotionRecord, violated []*Rule, only map[string]bool) ([]*Rule, error) {
+	now := time.Now()
+	checked := len(violated)
+	var rejectErr error
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if (only != nil && !only[rule.Name]) || containsRule(violated[:checked], rule) {
+			continue
+		}
+		err := rule.check(promotion, now)
+		if err == nil {
+			continue
+		}
+		violated = append(violated, rule)
+		if rule.Severity == SeverityReject && rejectErr == nil {
+			rejectErr = fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+	return violated, rejectErr
+}
+
+func containsRule(rules []*Rule, rule *Rule) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func priceCheck(check func(price money.Amount) error) func(*models.PromotionRecord, time.Time) error {
+	return func(p *models.PromotionRecord, _ time.Time) error {
+		if p.Operation == models.OperationDelete {
+			return nil
+		}
+		return check(p.Price)
+	}
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package csv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/money"
+)
+
+func promotionRecord(id, price string, expiration time.Time, op models.Operation) *models.PromotionRecord {
+	return &models.PromotionRecord{
+		Promotion: models.Promotion{ID: id, Price: money.MustParse(price), ExpirationDate: expiration},
+		Operation: op,
+	}
+}
+
+func TestRuleChecks(t *testing.T) {
+	now := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	future := now.Add(24 * time.Hour)
+	tests := []struct {
+		name      string
+		rule      string
+		value     string
+		promotion *models.PromotionRecord
+		want      error
+	}{
+		{name: "uuid", rule: "uuid_id", promotion: promotionRecord(id1, "1", future, models.OperationUpsert)},
+		{name: "uuid in upper case", rule: "uuid_id", promotion: promotionRecord("D018EF0B-DBD9-48F1-AC1A-EB4D90E57118", "1", future, models.OperationUpsert)},
+		{name: "uuid without hyphens", rule: "uuid_id", promotion: promotionRecord("d018ef0bdbd948f1ac1aeb4d90e57118", "1", future, models.OperationUpsert), want: ErrInvalidID},
+		{name: "uuid with a bad digit", rule: "uuid_id", promotion: promotionRecord("g018ef0b-dbd9-48f1-ac1a-eb4d90e57118", "1", future, models.OperationUpsert), want: ErrInvalidID},
+		{name: "delete without uuid", rule: "uuid_id", promotion: promotionRecord("sku-1", "0", time.Time{}, models.OperationDelete), want: ErrInvalidID},
+		{name: "min price", rule: "min_price", value: "1.00", promotion: promotionRecord(id1, "1", future, models.OperationUpsert)},
+		{name: "below min price", rule: "min_price", value: "1.00", promotion: promotionRecord(id1, "0.99", future, models.OperationUpsert), want: ErrInvalidPrice},
+		{name: "delete below min price", rule: "min_price", value: "1.00", promotion: promotionRecord(id1, "0", time.Time{}, models.OperationDelete)},
+		{name: "max price", rule: "max_price", value: "100", promotion: promotionRecord(id1, "100.00", future, models.OperationUpsert)},
+		{name: "above max price", rule: "max_price", value: "100", promotion: promotionRecord(id1, "100.001", future, models.OperationUpsert), want: ErrInvalidPrice},
+		{name: "max decimals", rule: "max_decimals", value: "2", promotion: promotionRecord(id1, "1.50", future, models.OperationUpsert)},
+		{name: "too many decimals", rule: "max_decimals", value: "2", promotion: promotionRecord(id1, "1.505", future, models.OperationUpsert), want: ErrInvalidPrice},
+		{name: "no decimals", rule: "max_decimals", value: "0", promotion: promotionRecord(id1, "1.5", future, models.OperationUpsert), want: ErrInvalidPrice},
+		{name: "not expired", rule: "not_expired", promotion: promotionRecord(id1, "1", future, models.OperationUpsert)},
+		{name: "expiring now", rule: "not_expired", promotion: promotionRecord(id1, "1", now, models.OperationUpsert), want: ErrInvalidExpirationDate},
+		{name: "expired", rule: "not_expired", promotion: promotionRecord(id1, "1", now.Add(-time.Second), models.OperationUpsert), want: ErrInvalidExpirationDate},
+		{name: "delete of expired", rule: "not_expired", promotion: promotionRecord(id1, "0", time.Time{}, models.OperationDelete)},
+		{name: "max validity", rule: "max_validity", value: "24h", promotion: promotionRecord(id1, "1", future, models.OperationUpsert)},
+		{name: "beyond max validity", rule: "max_validity", value: "24h", promotion: promotionRecord(id1, "1", future.Add(time.Second), models.OperationUpsert), want: ErrInvalidExpirationDate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := NewRule(tt.rule, tt.value, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = rule.check(tt.promotion, now)
+			if tt.want == nil && err != nil {
+				t.Errorf("check() error = %v, want none", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("check() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         string
+		value        string
+		severity     string
+		wantSeverity Severity
+		wantErr      bool
+	}{
+		{name: "default severity", rule: "min_price", value: "0", wantSeverity: SeverityReject},
+		{name: "warn", rule: "not_expired", severity: "warn", wantSeverity: SeverityWarn},
+		{name: "unknown rule", rule: "max_length", value: "10", wantErr: true},
+		{name: "unknown severity", rule: "uuid_id", severity: "error", wantErr: true},
+		{name: "bad price", rule: "max_price", value: "ten", wantErr: true},
+		{name: "negative decimals", rule: "max_decimals", value: "-1", wantErr: true},
+		{name: "bad duration", rule: "max_validity", value: "1 year", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := NewRule(tt.rule, tt.value, tt.severity)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NewRule() = %+v, want an error", rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rule.Name != tt.rule || rule.Severity != tt.wantSeverity {
+				t.Errorf("NewRule() = %s with severity %s, want %s with severity %s", rule.Name, rule.Severity, tt.rule, tt.wantSeverity)
+			}
+		})
+	}
+}
+
+func TestMergeRules(t *testing.T) {
+	decimals := mustRule("max_decimals", "4", SeverityReject)
+	validity := mustRule("max_validity", "8760h", SeverityWarn)
+	merged := mergeRules([]Rule{validity, decimals})
+
+	if len(merged) != len(DefaultRules)+1 {
+		t.Fatalf("got %d rules, want %d", len(merged), len(DefaultRules)+1)
+	}
+	for i, rule := range DefaultRules {
+		want := rule
+		if rule.Name == decimals.Name {
+			want = decimals
+		}
+		if merged[i].Name != want.Name || merged[i].Severity != want.Severity {
+			t.Errorf("rule %d = %s (%s), want %s (%s)", i, merged[i].Name, merged[i].Severity, want.Name, want.Severity)
+		}
+	}
+	if last := merged[len(merged)-1]; last.Name != validity.Name {
+		t.Errorf("last rule = %s, want %s", last.Name, validity.Name)
+	}
+
+	// The replacement is the profile's rule, with its value
+	p := promotionRecord(id1, "1.2345", time.Now().Add(time.Hour), models.OperationUpsert)
+	if _, err := (Profile{Rules: merged}).checkRules(p); err != nil {
+		t.Errorf("checkRules() error = %v, want none", err)
+	}
+}
+
+func TestRoundPrice(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []Rule
+		price     string
+		mode      money.RoundingMode
+		want      string
+		violated  []string
+		wantErr   error
+		preBroken bool
+	}{
+		{name: "within bounds", rules: []Rule{mustRule("max_price", "10.006", SeverityReject)}, price: "10.004", mode: money.RoundHalfUp, want: "10"},
+		{name: "rounded above max", rules: []Rule{mustRule("max_price", "10.006", SeverityReject)}, price: "10.005", mode: money.RoundHalfUp, violated: []string{"max_price"}, wantErr: ErrInvalidPrice},
+		{name: "rounded down below max", rules: []Rule{mustRule("max_price", "10.006", SeverityReject)}, price: "10.005", mode: money.RoundDown, want: "10"},
+		{name: "rounded below min", rules: []Rule{mustRule("min_price", "1.004", SeverityWarn)}, price: "1.005", mode: money.RoundDown, want: "1", violated: []string{"min_price"}},
+		{name: "broken before rounding", rules: []Rule{mustRule("max_price", "10.006", SeverityWarn)}, price: "10.007", mode: money.RoundHalfUp, want: "10.01", violated: []string{"max_price"}, preBroken: true},
+		{name: "other rules not rechecked", rules: []Rule{mustRule("max_decimals", "2", SeverityReject)}, price: "1.005", mode: money.RoundHalfUp, want: "1.01"},
+		{name: "outside stored range", price: "99999999.995", mode: money.RoundHalfUp, wantErr: ErrInvalidPrice},
+		{name: "exact", price: "1.005", mode: money.RoundExact, wantErr: ErrInvalidPrice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := Profile{Rules: tt.rules}
+			p := promotionRecord(id1, tt.price, time.Now().Add(time.Hour), models.OperationUpsert)
+			var violated []*Rule
+			if tt.preBroken {
+				violated = []*Rule{&profile.Rules[0]}
+			}
+			violated, err := profile.roundPrice(p, tt.mode, violated)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("roundPrice() error = %v, want none", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("roundPrice() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && p.Price.String() != tt.want {
+				t.Errorf("price = %s, want %s", p.Price, tt.want)
+			}
+			var names []string
+			for _, rule := range violated {
+				names = append(names, rule.Name)
+			}
+			if len(names) != len(tt.violated) || (len(names) > 0 && names[0] != tt.violated[0]) {
+				t.Errorf("violated = %v, want %v", names, tt.violated)
+			}
+		})
+	}
+}
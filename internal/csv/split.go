@@ -0,0 +1,482 @@
+package csv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/source"
+)
+
+// scanBufferSize is how far past a cut point a record boundary is looked
+// for, and how much of a range is counted at a time.
+const scanBufferSize = 1 << 20
+
+// splitRanges plans a split load of a plain file of size bytes into about
+// opts.SplitRanges ranges. It returns nil if the file is too small, of
+// unknown size (-1) or compressed to be split. The file is not scanned: every range starts at the
+// first record boundary after a cut point, found by reading just past it. The
+// returned checkpoints are where each range starts.
+func splitRanges(ctx context.Context, src source.Source, size int64, opts Options) ([]models.Checkpoint, error) {
+	n := int64(opts.SplitRanges)
+	if n < 2 || size < opts.MinSplitSize || size < n || CompressionFromFilename(src.Name()) != NoCompression {
+		return nil, nil
+	}
+	format, err := ParseFormat(string(opts.Format))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only CSV quotes fields, and only quoted fields can hold line breaks
+	var quoting *quoteSyntax
+	if format == FormatCSV {
+		quoting = &quoteSyntax{quote: opts.Profile.Quote, delimiter: []byte(string(opts.Profile.Delimiter))}
+	}
+	starts := make([]int64, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := int64(1); i < n; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			starts[i], errs[i] = findBoundary(ctx, src, i*size/n, size, quoting)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to split file: %w", err)
+		}
+	}
+
+	// A cut without a boundary in reach, which only happens inside a very
+	// long quoted field, or with the same boundary as the cut before it, is
+	// left to the range before it
+	ranges := []models.Checkpoint{{Range: &models.ByteRange{}}}
+	for _, start := range starts[1:] {
+		if last := ranges[len(ranges)-1].Range; start > last.Start && start < size {
+			last.End = start
+			ranges = append(ranges, models.Checkpoint{
+				Offset: start,
+				Range:  &models.ByteRange{Index: len(ranges), Start: start},
+			})
+		}
+	}
+	ranges[len(ranges)-1].Range.End = size
+	if len(ranges) < 2 {
+		return nil, nil
+	}
+
+	header, compressed, err := readHeader(ctx, src, ranges[0].Range.End, opts)
+	if err != nil || compressed {
+		return nil, err
+	}
+	for i := range ranges {
+		ranges[i].Header = header
+	}
+	return ranges, nil
+}
+
+// findBoundary returns the offset of the first record that starts at or
+// after cut, or -1 if none starts within scanBufferSize bytes.
+func findBoundary(ctx context.Context, src source.Source, cut, size int64, quoting *quoteSyntax) (int64, error) {
+	// The byte before the cut tells whether a record starts right at it
+	from := cut - 1
+	r, err := src.Open(ctx, from)
+	if err != nil {
+		return -1, err
+	}
+	defer r.Close()
+
+	window := int64(scanBufferSize)
+	if size-from < window {
+		window = size - from
+	}
+	buf := make([]byte, window)
+	n, err := io.ReadFull(&contextReader{ctx: ctx, r: r}, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return -1, err
+	}
+	i := recordStart(buf[:n], quoting)
+	if i < 0 {
+		return -1, nil
+	}
+	return from + int64(i), nil
+}
+
+// quoteSyntax is how fields of a CSV file are quoted.
+type quoteSyntax struct {
+	quote     byte
+	delimiter []byte
+}
+
+// recordStart returns the index in b of the first record that starts after
+// b[0], the byte before the cut, or -1 if none does. Without quoting every
+// line break ends a record. With it, only line breaks outside quoted fields
+// do, and whether the cut is inside a quoted field is told by the first quote
+// that can only open or only close one; without such a quote the cut is
+// taken to be outside.
+func recordStart(b []byte, quoting *quoteSyntax) int {
+	if quoting == nil {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return i + 1
+		}
+		return -1
+	}
+
+	// first holds the first line break after an even and an odd number of
+	// quotes past the cut, and inside whether the cut is inside quotes
+	first := [2]int{-1, -1}
+	inside := -1
+	quotes := 0
+	for i, c := range b {
+		if c == '\n' && first[quotes%2] < 0 {
+			first[quotes%2] = i + 1
+		}
+		if c == quoting.quote && i > 0 {
+			if inside < 0 {
+				switch quoting.role(b, i) {
+				case opensField:
+					inside = quotes % 2
+				case closesField:
+					inside = (quotes + 1) % 2
+				}
+			}
+			quotes++
+		}
+		if inside >= 0 && first[inside] >= 0 {
+			return first[inside]
+		}
+	}
+	if inside < 0 {
+		inside = 0
+	}
+	return first[inside]
+}
+
+const (
+	ambiguousQuote = iota
+	opensField
+	closesField
+)
+
+// role tells whether the quote at b[i] opens a quoted field, closes one, or
+// could be either, as a doubled quote or a quote around an empty field can.
+// An opening quote follows a delimiter or a line break and is followed by
+// field text; a closing quote is the other way round.
+func (q *quoteSyntax) role(b []byte, i int) int {
+	if i+1 >= len(b) {
+		return ambiguousQuote
+	}
+	prev, next := b[i-1], b[i+1]
+	fieldStart := prev == '\n' || bytes.HasSuffix(b[:i], q.delimiter)
+	fieldEnd := next == '\n' || next == '\r' || bytes.HasPrefix(b[i+1:], q.delimiter)
+	switch {
+	case fieldStart && !fieldEnd && next != q.quote:
+		return opensField
+	case fieldEnd && !fieldStart && prev != q.quote:
+		return closesField
+	}
+	return ambiguousQuote
+}
+
+// readHeader returns the header of a delimited file, or nil if it has none,
+// by decoding the first record of the first range. It also tells whether the
+// file turns out to be compressed by its magic bytes, in which case it
+// cannot be split.
+func readHeader(ctx context.Context, src source.Source, end int64, opts Options) ([]string, bool, error) {
+	format, err := ParseFormat(string(opts.Format))
+	if err != nil {
+		return nil, false, err
+	}
+	r, err := src.Open(ctx, 0)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(io.LimitReader(r, end))
+	if head, _ := br.Peek(4); sniffCompression(head) != NoCompression {
+		return nil, true, nil
+	}
+	opts.Resume = nil
+	decoder, err := decoders[format](br, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	delimited, ok := decoder.(*delimitedDecoder)
+	if !ok {
+		return nil, false, nil
+	}
+	if _, err := delimited.Next(); err != nil && err != io.EOF {
+		if _, ok := err.(*RecordError); !ok {
+			return nil, false, err
+		}
+	}
+	return delimited.header, false, nil
+}
+
+// processSplit runs a pipeline, with its own batch writer, on every range of
+// a split load. Every range has its own checkpoint and reject report; the
+// reports are appended to opts.Rejects once the load has ended, unless it was
+// cancelled. Records of a range after the first are numbered from the start
+// of the range, and the reports and the error of the load are renumbered
+// with lines of the file once the ranges before them have been read.
+func processSplit(ctx context.Context, src source.Source, sink PromotionSink, stats *Stats, opts Options, ranges []models.Checkpoint) error {
+	var violations []models.RuleViolation
+	for _, rc := range ranges {
+		stats.RowsRead.Add(rc.RowsRead)
+		stats.RowsWritten.Add(rc.RowsWritten)
+		stats.RowsRejected.Add(rc.RowsRejected)
+		stats.BytesRead.Add(rc.Offset - rc.Range.Start)
+		violations = mergeViolations(violations, rc.RuleViolations)
+	}
+	stats.setRuleViolations(violations)
+
+	// Record the plan before any range runs, so that an interrupted load is
+	// resumed with the same ranges
+	if opts.Resume == nil {
+		for i := range ranges {
+			cp := ranges[i]
+			if err := sink(ctx, nil, &cp); err != nil {
+				return err
+			}
+		}
+	}
+
+	reports := make([]*RejectReport, len(ranges))
+	if opts.Rejects != nil {
+		for i, rc := range ranges {
+			report, err := OpenRejectReport(opts.Rejects.path+".range-"+strconv.Itoa(rc.Range.Index), rc.RejectReportSize)
+			if err != nil {
+				for _, report := range reports[:i] {
+					report.Close()
+				}
+				return err
+			}
+			reports[i] = report
+		}
+	}
+
+	rangeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The ranges are read concurrently, so the file is hashed in a pass of its
+	// own alongside them, unless the load is resumed and its checksum unknown
+	var checksum chan hashResult
+	if opts.Resume == nil {
+		checksum = make(chan hashResult, 1)
+		go func() {
+			sum, err := hashSource(rangeCtx, src)
+			checksum <- hashResult{sum: sum, err: err}
+		}()
+	}
+
+	var mu sync.Mutex
+	var processErr error
+	failed := -1
+	progress := make([]rangeProgress, len(ranges))
+	workers := (opts.WorkerCount + len(ranges) - 1) / len(ranges)
+	var wg sync.WaitGroup
+	for i := range ranges {
+		rangeOpts := opts
+		rangeOpts.WorkerCount = workers
+		rangeOpts.Resume = &ranges[i]
+		rangeOpts.Rejects = reports[i]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := processRange(rangeCtx, src, sink, stats, rangeOpts, &progress[i]); err != nil {
+				// The first error stops the other ranges
+				mu.Lock()
+				if processErr == nil {
+					processErr, failed = err, i
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// An interrupted load keeps the reports of its ranges for the resume
+	if ctx.Err() != nil {
+		for _, report := range reports {
+			if report != nil {
+				report.Close()
+			}
+		}
+		return processErr
+	}
+
+	// Only the ranges up to the last one with rows to renumber need their
+	// lines counted, which for ranges stopped by an error means reading the
+	// rest of them
+	last := failed
+	for i, report := range reports {
+		if report != nil && i > last && (ranges[i].RowsRejected > 0 || report.Rows() > 0) {
+			last = i
+		}
+	}
+	lines, err := lineOffsets(ctx, src, ranges, progress, last)
+	if err != nil && processErr == nil {
+		processErr = err
+	}
+	var rowErr *RowError
+	if failed >= 0 && failed < len(lines) && errors.As(processErr, &rowErr) {
+		rowErr.Line += lines[failed]
+	}
+	for i, report := range reports {
+		if report == nil {
+			continue
+		}
+		offset := 0
+		if i < len(lines) {
+			offset = lines[i]
+		} else if i <= last {
+			// Rows that cannot be renumbered are left out rather than misnumbered
+			report.Close()
+			continue
+		}
+		if err := opts.Rejects.appendReport(report, offset); err != nil && processErr == nil {
+			processErr = err
+		}
+	}
+	if processErr != nil {
+		return processErr
+	}
+	if err := (&rejecter{opts: opts, stats: stats}).checkBudget(); err != nil {
+		return err
+	}
+	if checksum != nil {
+		result := <-checksum
+		if result.err != nil {
+			return result.err
+		}
+		stats.setChecksum(result.sum)
+	}
+	return nil
+}
+
+type hashResult struct {
+	sum string
+	err error
+}
+
+// hashSource returns the hex-encoded SHA-256 of a whole source.
+func hashSource(ctx context.Context, src source.Source) (string, error) {
+	r, err := src.Open(ctx, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	return drainChecksum(ctx, io.TeeReader(r, h), h)
+}
+
+// rangeProgress is how far a range has been read: up to offset, with lines
+// line breaks from the start of the range.
+type rangeProgress struct {
+	offset int64
+	lines  int
+}
+
+// lineOffsets returns, for the ranges up to last, what to add to the lines of
+// their records to number them as in the file. Ranges are read to their end
+// where they were not, to count their lines.
+func lineOffsets(ctx context.Context, src source.Source, ranges []models.Checkpoint, progress []rangeProgress, last int) ([]int, error) {
+	offsets := make([]int, 0, last+1)
+	before := 0
+	for i := 0; i <= last; i++ {
+		rc := ranges[i]
+		offsets = append(offsets, before)
+		if i == last {
+			break
+		}
+		lines, err := countLines(ctx, src, progress[i].offset, rc.Range.End)
+		if err != nil {
+			return offsets, fmt.Errorf("failed to count lines of range %d: %w", rc.Range.Index, err)
+		}
+		before += progress[i].lines + lines
+	}
+	return offsets, nil
+}
+
+// countLines counts the line breaks between two offsets of a file.
+func countLines(ctx context.Context, src source.Source, start, end int64) (int, error) {
+	if start >= end {
+		return 0, nil
+	}
+	r, err := src.Open(ctx, start)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	counter := &lineCounter{r: &contextReader{ctx: ctx, r: io.LimitReader(r, end-start)}}
+	if _, err := io.CopyBuffer(io.Discard, counter, make([]byte, scanBufferSize)); err != nil {
+		return 0, err
+	}
+	return counter.lines, nil
+}
+
+// processRange runs the pipeline on the rest of a range, from its checkpoint,
+// and records how far it got in progress.
+func processRange(ctx context.Context, src source.Source, sink PromotionSink, stats *Stats, opts Options, progress *rangeProgress) error {
+	rc := opts.Resume
+	progress.offset, progress.lines = rc.Offset, rc.Line
+	if rc.Offset >= rc.Range.End {
+		return nil
+	}
+	r, err := src.Open(ctx, rc.Offset)
+	if err != nil {
+		return fmt.Errorf("failed to open range %d: %w", rc.Range.Index, err)
+	}
+	defer r.Close()
+
+	counter := &lineCounter{r: io.LimitReader(r, rc.Range.End-rc.Offset)}
+	defer func() {
+		progress.offset += counter.n
+		progress.lines += counter.lines
+	}()
+	return processRecords(ctx, &countingReader{r: counter, n: &stats.BytesRead}, sink, stats, opts)
+}
+
+// lineCounter counts the bytes and line breaks read through it.
+type lineCounter struct {
+	r     io.Reader
+	n     int64
+	lines int
+}
+
+func (l *lineCounter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	l.lines += bytes.Count(p[:n], []byte{'\n'})
+	return n, err
+}
+
+// mergeViolations adds the counts of b to a.
+func mergeViolations(a, b []models.RuleViolation) []models.RuleViolation {
+	for _, violation := range b {
+		found := false
+		for i := range a {
+			if a[i].Rule == violation.Rule {
+				a[i].Rows += violation.Rows
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, violation)
+		}
+	}
+	return a
+}
@@ -0,0 +1,258 @@
+package csv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/source"
+)
+
+// memorySource is a source held in memory.
+type memorySource struct {
+	name string
+	data []byte
+}
+
+func (m memorySource) Open(_ context.Context, offset int64) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(m.data[offset:])), nil
+}
+
+func (m memorySource) Stat(context.Context) (source.Info, error) {
+	return source.Info{Size: int64(len(m.data)), Ranges: true}, nil
+}
+
+func (m memorySource) Name() string {
+	return m.name
+}
+
+func TestRecordStart(t *testing.T) {
+	csvQuoting := &quoteSyntax{quote: '"', delimiter: []byte(",")}
+	tests := []struct {
+		name    string
+		in      string
+		quoting *quoteSyntax
+		want    int
+	}{
+		{name: "unquoted", in: "a,b\nc,d\n", want: 4},
+		{name: "cut at record start", in: "\nc,d\n", want: 1},
+		{name: "no line break", in: "abc", want: -1},
+		{name: "csv without quotes", in: "a,b\nc,d\n", quoting: csvQuoting, want: 4},
+		{name: "csv cut at record start", in: "\nc,d\n", quoting: csvQuoting, want: 1},
+		// The cut is inside "x\ny": the closing quote follows field text
+		{name: "inside quoted field", in: "x\ny\",z\nn,m\n", quoting: csvQuoting, want: 7},
+		// The cut is before a field that opens a quote
+		{name: "before quoted field", in: "a,\"x\ny\",z\nn\n", quoting: csvQuoting, want: 10},
+		// Doubled quotes decide nothing; the closing quote does
+		{name: "doubled quotes inside", in: "a \"\"b\"\"\nc\",d\ne\n", quoting: csvQuoting, want: 13},
+		// An empty quoted field decides nothing; the opening quote after it does
+		{name: "empty quoted field", in: ",\"\",\"p\nq\"\nr\n", quoting: csvQuoting, want: 10},
+		{name: "no decisive quote", in: "x\"\"\nb\n", quoting: csvQuoting, want: 4},
+		{name: "inside without boundary", in: "x\ny\",z", quoting: csvQuoting, want: -1},
+		{name: "crlf", in: "x\r\ny\",z\r\nn\r\n", quoting: csvQuoting, want: 9},
+		{name: "other quote", in: "x\ny',z\nn\n", quoting: &quoteSyntax{quote: '\'', delimiter: []byte(",")}, want: 7},
+		{name: "tab delimiter", in: "x\ny\"\tz\nn\n", quoting: &quoteSyntax{quote: '"', delimiter: []byte("\t")}, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recordStart([]byte(tt.in), tt.quoting); got != tt.want {
+				t.Errorf("recordStart(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("id,price,expiration_date,note\n")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "00000000-0000-0000-0000-%012d,1.00,2030-01-01,\"a\nb, \"\"c\"\"\"\n", i)
+	}
+	data := []byte(sb.String())
+
+	tests := []struct {
+		name       string
+		src        memorySource
+		splits     int
+		minSize    int64
+		wantRanges bool
+	}{
+		{name: "split", src: memorySource{name: "a.csv", data: data}, splits: 7, wantRanges: true},
+		{name: "one range", src: memorySource{name: "a.csv", data: data}, splits: 1},
+		{name: "too small", src: memorySource{name: "a.csv", data: data}, splits: 7, minSize: int64(len(data)) + 1},
+		{name: "compressed name", src: memorySource{name: "a.csv.gz", data: data}, splits: 7},
+		{name: "compressed content", src: memorySource{name: "a.csv", data: append([]byte{0x1f, 0x8b}, data...)}, splits: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{SplitRanges: tt.splits, MinSplitSize: tt.minSize, Profile: DefaultProfile, Format: FormatCSV, Mode: FullLoad}
+			ranges, err := splitRanges(context.Background(), tt.src, int64(len(tt.src.data)), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantRanges {
+				if ranges != nil {
+					t.Fatalf("got %d ranges, want none", len(ranges))
+				}
+				return
+			}
+			if len(ranges) != tt.splits {
+				t.Fatalf("got %d ranges, want %d", len(ranges), tt.splits)
+			}
+			var end int64
+			for i, rc := range ranges {
+				if rc.Range.Index != i || rc.Range.Start != end || rc.Offset != rc.Range.Start || rc.Range.End <= rc.Range.Start {
+					t.Errorf("range %d is %+v at offset %d, want it to start at %d", i, *rc.Range, rc.Offset, end)
+				}
+				if i > 0 && !bytes.HasPrefix(data[rc.Range.Start:], []byte("00000000-")) {
+					t.Errorf("range %d starts inside a record: %q", i, data[rc.Range.Start:rc.Range.Start+10])
+				}
+				if strings.Join(rc.Header, ",") != "id,price,expiration_date,note" {
+					t.Errorf("range %d has header %q", i, rc.Header)
+				}
+				end = rc.Range.End
+			}
+			if end != int64(len(data)) {
+				t.Errorf("ranges end at %d, want %d", end, len(data))
+			}
+		})
+	}
+}
+
+// TestSplitLoadMatchesSequential checks that a split load rejects the same
+// rows, with the same lines, stages the same promotions in the same order
+// and records the same checksum as a sequential load.
+func TestSplitLoadMatchesSequential(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("id,price,expiration_date,note\n")
+	for i := 0; i < 3000; i++ {
+		id := fmt.Sprintf("00000000-0000-0000-0000-%012d", i%2900)
+		switch i % 13 {
+		case 3:
+			fmt.Fprintf(&sb, "%s,not a price,2030-01-01,x\n", id)
+		case 5:
+			fmt.Fprintf(&sb, "%s,1.50,2030-01-01,\"multi\nline, \"\"quoted\"\"\nnote\"\n", id)
+		case 7:
+			fmt.Fprintf(&sb, "\n\"%s\",2.00,2030-01-01,\"a\"\n", id)
+		case 11:
+			fmt.Fprintf(&sb, "%s,3.00,2030-01-01,bare\"quote\n", id)
+		default:
+			fmt.Fprintf(&sb, "%s,1.00,2030-01-01,plain\n", id)
+		}
+	}
+	src := memorySource{name: "promotions.csv", data: []byte(sb.String())}
+
+	sum := sha256.Sum256(src.data)
+	wantChecksum := hex.EncodeToString(sum[:])
+	load := func(t *testing.T, ranges int, policy ErrorPolicy) (string, []string, error) {
+		rejects, err := CreateRejectReport(filepath.Join(t.TempDir(), "rejects.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		type staged struct {
+			order int64
+			id    string
+		}
+		var rows []staged
+		sink := func(_ context.Context, batch []*models.PromotionRecord, cp *models.Checkpoint) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, p := range batch {
+				rows = append(rows, staged{order: stagedOrder(p.Line, cp), id: p.ID})
+			}
+			return nil
+		}
+		opts := Options{WorkerCount: 4, BatchSize: 16, ErrorPolicy: policy, SplitRanges: ranges,
+			Profile: DefaultProfile, Format: FormatCSV, Mode: FullLoad, Rejects: rejects}
+		stats := &Stats{}
+		loadErr := ProcessPromotionsFromCSV(context.Background(), src, sink, stats, opts)
+		if loadErr == nil && stats.Checksum() != wantChecksum {
+			t.Errorf("checksum = %q, want %q", stats.Checksum(), wantChecksum)
+		}
+		if err := rejects.Close(); err != nil {
+			t.Fatal(err)
+		}
+		report, err := os.ReadFile(rejects.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i].order < rows[j].order })
+		ids := make([]string, len(rows))
+		for i, row := range rows {
+			ids[i] = row.id
+		}
+		return string(report), ids, loadErr
+	}
+
+	wantReport, wantIDs, err := load(t, 1, SkipInvalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ranges := range []int{2, 3, 7, 50} {
+		t.Run(fmt.Sprintf("%d ranges", ranges), func(t *testing.T) {
+			report, ids, err := load(t, ranges, SkipInvalid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report != wantReport {
+				t.Errorf("reject report differs from a sequential load:\n%s\nwant:\n%s", head(report), head(wantReport))
+			}
+			if strings.Join(ids, ",") != strings.Join(wantIDs, ",") {
+				t.Errorf("staged promotions differ from a sequential load")
+			}
+		})
+	}
+}
+
+// TestSplitLoadErrorLine checks that the row that aborts a split load is
+// reported with its line in the file.
+func TestSplitLoadErrorLine(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("id,price,expiration_date,note\n")
+	for i := 0; i < 3000; i++ {
+		price := "1.00"
+		if i == 2500 {
+			price = "bad"
+		}
+		fmt.Fprintf(&sb, "00000000-0000-0000-0000-%012d,%s,2030-01-01,\"a\nb\"\n", i, price)
+	}
+	src := memorySource{name: "promotions.csv", data: []byte(sb.String())}
+	discard := func(context.Context, []*models.PromotionRecord, *models.Checkpoint) error { return nil }
+
+	for _, ranges := range []int{1, 7} {
+		opts := Options{WorkerCount: 4, BatchSize: 16, ErrorPolicy: FailFast, SplitRanges: ranges,
+			Profile: DefaultProfile, Format: FormatCSV, Mode: FullLoad}
+		err := ProcessPromotionsFromCSV(context.Background(), src, discard, &Stats{}, opts)
+		rowErr, ok := err.(*RowError)
+		// Every record before the bad one takes two lines, after the header
+		if !ok || rowErr.Line != 2+2*2500 {
+			t.Errorf("%d ranges: error = %v, want one on line %d", ranges, err, 2+2*2500)
+		}
+	}
+}
+
+// stagedOrder orders rows the way the staging tables do.
+func stagedOrder(line int, cp *models.Checkpoint) int64 {
+	if cp.Range == nil {
+		return int64(line)
+	}
+	return int64(cp.Range.Index)<<32 | int64(line)
+}
+
+func head(s string) string {
+	if len(s) > 500 {
+		return s[:500] + "…"
+	}
+	return s
+}
@@ -0,0 +1,87 @@
+package csv
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+// Stats counts rows as they move through the pipeline. It is safe to read
+// while a file is still being processed.
+type Stats struct {
+	RowsRead     atomic.Int64
+	RowsWritten  atomic.Int64
+	RowsRejected atomic.Int64
+	// Duplicates counts rows dropped because an earlier or better row has the
+	// same ID. It is only known once the load is published.
+	Duplicates atomic.Int64
+	// BytesRead is how much of the input has been read and BytesTotal its
+	// size, or 0 if it is unknown. For compressed input both count
+	// compressed bytes.
+	BytesRead  atomic.Int64
+	BytesTotal atomic.Int64
+
+	mu         sync.Mutex
+	violations []models.RuleViolation
+	checksum   string
+}
+
+// Checksum returns the hex-encoded SHA-256 of the input, taken as it was
+// read, or "" if the load has not finished or was resumed part way through
+// the input. A split load hashes the file in a pass of its own, so its
+// checksum is the same as a sequential load's.
+func (s *Stats) Checksum() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checksum
+}
+
+func (s *Stats) setChecksum(checksum string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checksum = checksum
+}
+
+// RuleViolations returns the rows that broke each business rule so far,
+// ordered by rule name.
+func (s *Stats) RuleViolations() []models.RuleViolation {
+	s.mu.Lock()
+	violations := append([]models.RuleViolation(nil), s.violations...)
+	s.mu.Unlock()
+
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Rule < violations[j].Rule })
+	return violations
+}
+
+func (s *Stats) setRuleViolations(violations []models.RuleViolation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.violations = append(s.violations[:0], violations...)
+}
+
+// addRuleViolations counts a row that broke the given rules.
+func (s *Stats) addRuleViolations(rules []*Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.violations = countViolations(s.violations, rules)
+}
+
+// countViolations adds a row that broke the given rules to violations.
+func countViolations(violations []models.RuleViolation, rules []*Rule) []models.RuleViolation {
+	for _, rule := range rules {
+		found := false
+		for i := range violations {
+			if violations[i].Rule == rule.Name {
+				violations[i].Rows++
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, models.RuleViolation{Rule: rule.Name, Severity: string(rule.Severity), Rows: 1})
+		}
+	}
+	return violations
+}
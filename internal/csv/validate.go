@@ -0,0 +1,193 @@
+package csv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/source"
+)
+
+// ValidationSummary describes what loading a file would do, without loading
+// it. Errors and DuplicateIDs list only the first few entries.
+type ValidationSummary struct {
+	Rows                   int64      `json:"rows"`
+	ValidRows              int64      `json:"valid_rows"`
+	RejectedRows           int64      `json:"rejected_rows"`
+	InvalidPrices          int64      `json:"invalid_prices"`
+	InvalidCurrencies      int64      `json:"invalid_currencies"`
+	InvalidExpirationDates int64      `json:"invalid_expiration_dates"`
+	InvalidStartDates      int64      `json:"invalid_start_dates"`
+	ExpiredRows            int64      `json:"expired_rows"`
+	ScheduledRows          int64      `json:"scheduled_rows"`
+	DuplicateIDCount       int64      `json:"duplicate_id_count"`
+	DuplicateIDs           []string   `json:"duplicate_ids"`
+	MinExpirationDate      *time.Time `json:"min_expiration_date,omitempty"`
+	MaxExpirationDate      *time.Time `json:"max_expiration_date,omitempty"`
+	// Currencies counts the valid rows priced in each currency.
+	Currencies map[string]int64 `json:"currencies"`
+	// RuleViolations counts the rows that broke each business rule, whether
+	// they would be rejected or loaded with a warning.
+	RuleViolations []models.RuleViolation `json:"rule_violations"`
+	Errors         []ValidationError      `json:"errors"`
+	// Accepted tells whether a load would get past the error policy; if not,
+	// PolicyError says why.
+	Accepted    bool   `json:"accepted"`
+	PolicyError string `json:"policy_error,omitempty"`
+}
+
+type ValidationError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// validator builds a ValidationSummary. It is only called from the batch
+// writer, so it needs no locking.
+type validator struct {
+	summary   ValidationSummary
+	maxErrors int
+	now       time.Time
+	// seen holds the line each ID first occurred on, or -1 once the ID has
+	// been counted as a duplicate.
+	seen map[string]int
+}
+
+// ValidatePromotionsFromCSV runs a file through the same parsing as a load
+// and summarizes the result. Nothing is written anywhere.
+func ValidatePromotionsFromCSV(ctx context.Context, src source.Source, opts Options, maxErrors int) (*ValidationSummary, error) {
+	file, err := src.Open(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return ValidatePromotionsFromReader(ctx, file, src.Name(), opts, maxErrors)
+}
+
+// ValidatePromotionsFromReader is ValidatePromotionsFromCSV for a stream.
+// Compressed input is detected from its magic bytes or the extension of name.
+func ValidatePromotionsFromReader(ctx context.Context, r io.Reader, name string, opts Options, maxErrors int) (*ValidationSummary, error) {
+	decompressed, _, err := decompress(r, name)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
+
+	v := &validator{
+		summary:   ValidationSummary{DuplicateIDs: []string{}, Currencies: map[string]int64{}, Errors: []ValidationError{}},
+		maxErrors: maxErrors,
+		now:       time.Now().UTC(),
+		seen:      make(map[string]int),
+	}
+
+	// Read the whole file whatever the error policy, and judge the policy
+	// on the totals afterwards
+	policy := opts
+	opts.ErrorPolicy = SkipInvalid
+	opts.MaxRejectedRows = 0
+	opts.MaxRejectedPercent = 0
+	opts.Rejects = nil
+	opts.Resume = nil
+	opts.onReject = v.reject
+
+	stats := &Stats{}
+	if err := ProcessPromotionsFromReader(ctx, decompressed, v.add, stats, opts); err != nil {
+		return nil, err
+	}
+
+	v.summary.Rows = stats.RowsRead.Load()
+	v.summary.RejectedRows = stats.RowsRejected.Load()
+	v.summary.ValidRows = v.summary.Rows - v.summary.RejectedRows
+	v.summary.RuleViolations = stats.RuleViolations()
+	if v.summary.RuleViolations == nil {
+		v.summary.RuleViolations = []models.RuleViolation{}
+	}
+	if err := v.checkPolicy(policy); err != nil {
+		v.summary.PolicyError = err.Error()
+	} else {
+		v.summary.Accepted = true
+	}
+	return &v.summary, nil
+}
+
+func (v *validator) add(_ context.Context, batch []*models.PromotionRecord, _ *models.Checkpoint) error {
+	for _, p := range batch {
+		if first, ok := v.seen[p.ID]; ok {
+			if first >= 0 {
+				v.summary.DuplicateIDCount++
+				if len(v.summary.DuplicateIDs) < v.maxErrors {
+					v.summary.DuplicateIDs = append(v.summary.DuplicateIDs, p.ID)
+				}
+				v.seen[p.ID] = -1
+			}
+		} else {
+			v.seen[p.ID] = p.Line
+		}
+
+		if p.Operation == models.OperationDelete {
+			continue
+		}
+		v.summary.Currencies[p.Currency]++
+		date := p.ExpirationDate
+		if date.Before(v.now) {
+			v.summary.ExpiredRows++
+		}
+		if p.StartsAt != nil && p.StartsAt.After(v.now) {
+			v.summary.ScheduledRows++
+		}
+		if v.summary.MinExpirationDate == nil || date.Before(*v.summary.MinExpirationDate) {
+			v.summary.MinExpirationDate = &date
+		}
+		if v.summary.MaxExpirationDate == nil || date.After(*v.summary.MaxExpirationDate) {
+			v.summary.MaxExpirationDate = &date
+		}
+	}
+	return nil
+}
+
+func (v *validator) reject(line int, _ string, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidPrice):
+		v.summary.InvalidPrices++
+	case errors.Is(err, ErrInvalidCurrency):
+		v.summary.InvalidCurrencies++
+	case errors.Is(err, ErrInvalidExpirationDate):
+		v.summary.InvalidExpirationDates++
+	case errors.Is(err, ErrInvalidStartDate):
+		v.summary.InvalidStartDates++
+	}
+	if len(v.summary.Errors) < v.maxErrors {
+		v.summary.Errors = append(v.summary.Errors, ValidationError{Line: line, Error: err.Error()})
+	}
+}
+
+// checkPolicy applies the error and duplicate policies of a load to the
+// totals.
+func (v *validator) checkPolicy(opts Options) error {
+	if opts.Mode != DeltaLoad && opts.DuplicatePolicy == models.DuplicateReject && v.summary.DuplicateIDCount > 0 {
+		return fmt.Errorf("file repeats %d promotion IDs", v.summary.DuplicateIDCount)
+	}
+
+	rejected := v.summary.RejectedRows
+	if rejected == 0 {
+		return nil
+	}
+	if opts.ErrorPolicy != SkipInvalid {
+		if len(v.summary.Errors) == 0 {
+			return fmt.Errorf("%d rows rejected", rejected)
+		}
+		first := v.summary.Errors[0]
+		return &RowError{Line: first.Line, Err: errors.New(first.Error)}
+	}
+	if opts.MaxRejectedRows > 0 && rejected > opts.MaxRejectedRows {
+		return fmt.Errorf("error budget of %d rejected rows exceeded: %d rows rejected", opts.MaxRejectedRows, rejected)
+	}
+
+	stats := &Stats{}
+	stats.RowsRead.Store(v.summary.Rows)
+	stats.RowsRejected.Store(rejected)
+	return (&rejecter{opts: opts, stats: stats}).checkBudget()
+}
@@ -0,0 +1,24 @@
+package currency
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidCode = errors.New("invalid currency code")
+
+// ParseCode returns an ISO 4217 currency code in its canonical upper case
+// form. Any three letters are accepted, so that new codes need no release.
+func ParseCode(s string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+	if len(code) != 3 {
+		return "", fmt.Errorf("%w %q", ErrInvalidCode, s)
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return "", fmt.Errorf("%w %q", ErrInvalidCode, s)
+		}
+	}
+	return code, nil
+}
@@ -0,0 +1,201 @@
+package currency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/money"
+	"github.com/sh3ll3y/promotion-service/internal/source"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoRates is returned while no rates table has been loaded.
+	ErrNoRates      = errors.New("exchange rates are not available")
+	ErrUnknownRate  = errors.New("no exchange rate")
+	errInvalidRates = errors.New("invalid exchange rates")
+)
+
+const (
+	// rateScale is the number of decimal places of cross rates.
+	rateScale = 10
+	// conversionRounding rounds converted prices and cross rates.
+	conversionRounding = money.RoundHalfEven
+	// maxRatesSize limits how much of a rates file is read.
+	maxRatesSize = 1 << 20
+)
+
+// Rates is a table of exchange rates: how much of each currency one unit of
+// Base buys, as of Timestamp.
+type Rates struct {
+	Base      string                  `json:"base"`
+	Timestamp time.Time               `json:"timestamp"`
+	Rates     map[string]money.Amount `json:"rates"`
+}
+
+// Conversion is a price converted into another currency, with the rate and
+// the timestamp of the table it was converted with.
+type Conversion struct {
+	Price     money.Amount
+	Rate      money.Amount
+	Timestamp time.Time
+}
+
+// Rate returns how much of currency to one unit of currency from buys,
+// rounded to rateScale decimal places. Rates between two currencies other
+// than the base are crossed through the base.
+func (r *Rates) Rate(from, to string) (money.Amount, error) {
+	fromRate, toRate, err := r.pair(from, to)
+	if err != nil {
+		return money.Amount{}, err
+	}
+	return toRate.Quo(fromRate, rateScale, conversionRounding)
+}
+
+// pair returns the rates of two currencies against the base.
+func (r *Rates) pair(from, to string) (money.Amount, money.Amount, error) {
+	fromRate, err := r.rate(from)
+	if err != nil {
+		return money.Amount{}, money.Amount{}, err
+	}
+	toRate, err := r.rate(to)
+	if err != nil {
+		return money.Amount{}, money.Amount{}, err
+	}
+	return fromRate, toRate, nil
+}
+
+func (r *Rates) rate(code string) (money.Amount, error) {
+	if code == r.Base {
+		return money.New(1, 0), nil
+	}
+	rate, ok := r.Rates[code]
+	if !ok {
+		return money.Amount{}, fmt.Errorf("%w for %s", ErrUnknownRate, code)
+	}
+	return rate, nil
+}
+
+// Convert converts a price from one currency into another, rounded to
+// models.PriceScale decimal places. The price is converted with the exact
+// cross rate and rounded once; the rate of the conversion is rounded as Rate
+// rounds it.
+func (r *Rates) Convert(price money.Amount, from, to string) (*Conversion, error) {
+	fromRate, toRate, err := r.pair(from, to)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := price.MulQuo(toRate, fromRate, models.PriceScale, conversionRounding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s %s to %s: %w", price, from, to, err)
+	}
+	rate, err := toRate.Quo(fromRate, rateScale, conversionRounding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s %s to %s: %w", price, from, to, err)
+	}
+	return &Conversion{Price: converted, Rate: rate, Timestamp: r.Timestamp}, nil
+}
+
+// validate canonicalizes the currency codes of a loaded table.
+func (r *Rates) validate() error {
+	base, err := ParseCode(r.Base)
+	if err != nil {
+		return fmt.Errorf("%w: base: %w", errInvalidRates, err)
+	}
+	rates := make(map[string]money.Amount, len(r.Rates))
+	for code, rate := range r.Rates {
+		canonical, err := ParseCode(code)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidRates, err)
+		}
+		if rate.Sign() <= 0 {
+			return fmt.Errorf("%w: rate for %s is not positive", errInvalidRates, canonical)
+		}
+		rates[canonical] = rate
+	}
+	r.Base, r.Rates = base, rates
+	return nil
+}
+
+// Table holds the current exchange rates, loaded from a JSON file of Rates
+// that is read again every interval. A table that fails to load is logged
+// and the previous one kept.
+type Table struct {
+	src      source.Source
+	interval time.Duration
+	rates    atomic.Pointer[Rates]
+}
+
+func NewTable(src source.Source, interval time.Duration) *Table {
+	return &Table{src: src, interval: interval}
+}
+
+// Start loads the rates and keeps reloading them until ctx is cancelled.
+// The first load is not waited for, so an unavailable rates source does
+// not keep the service from starting.
+func (t *Table) Start(ctx context.Context) error {
+	if t.interval <= 0 {
+		return fmt.Errorf("invalid exchange rate refresh interval %s", t.interval)
+	}
+	go t.run(ctx)
+	return nil
+}
+
+func (t *Table) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		if err := t.Load(ctx); err != nil && ctx.Err() == nil {
+			logging.Logger.Error("Failed to load exchange rates", zap.Error(err), zap.String("source", t.src.Name()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Load reads the rates from the source and makes them current.
+func (t *Table) Load(ctx context.Context) error {
+	r, err := t.src.Open(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open exchange rates: %w", err)
+	}
+	defer r.Close()
+
+	var rates Rates
+	if err := json.NewDecoder(io.LimitReader(r, maxRatesSize)).Decode(&rates); err != nil {
+		return fmt.Errorf("failed to decode exchange rates: %w", err)
+	}
+	if err := rates.validate(); err != nil {
+		return err
+	}
+	if rates.Timestamp.IsZero() {
+		rates.Timestamp = time.Now()
+	}
+	rates.Timestamp = rates.Timestamp.UTC()
+	t.rates.Store(&rates)
+	logging.Logger.Info("Loaded exchange rates", zap.String("base", rates.Base), zap.Int("currencies", len(rates.Rates)), zap.Time("timestamp", rates.Timestamp))
+	return nil
+}
+
+// Rates returns the current rates, or ErrNoRates if none have been loaded.
+// A nil table has no rates.
+func (t *Table) Rates() (*Rates, error) {
+	if t == nil {
+		return nil, ErrNoRates
+	}
+	rates := t.rates.Load()
+	if rates == nil {
+		return nil, ErrNoRates
+	}
+	return rates, nil
+}
@@ -0,0 +1,48 @@
+package currency
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sh3ll3y/promotion-service/internal/money"
+)
+
+func TestConvert(t *testing.T) {
+	rates := &Rates{Base: "EUR", Rates: map[string]money.Amount{
+		"USD": money.MustParse("1.0843"),
+		"JPY": money.MustParse("157.39"),
+	}}
+	tests := []struct {
+		name      string
+		price     string
+		from, to  string
+		want      string
+		wantRate  string
+		wantError error
+	}{
+		{name: "from base", price: "10.00", from: "EUR", to: "USD", want: "10.84", wantRate: "1.0843"},
+		{name: "to base", price: "10.84", from: "USD", to: "EUR", want: "10", wantRate: "0.9222539887"},
+		{name: "same currency", price: "10.00", from: "USD", to: "USD", want: "10", wantRate: "1"},
+		// The cross rate rounded to 10 decimals, 145.1535552891, converts
+		// this price to 2519199.46
+		{name: "cross rate", price: "17355.41", from: "USD", to: "JPY", want: "2519199.47", wantRate: "145.1535552891"},
+		{name: "unknown currency", price: "1", from: "USD", to: "GBP", wantError: ErrUnknownRate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rates.Convert(money.MustParse(tt.price), tt.from, tt.to)
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Errorf("Convert() error = %v, want %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Price != money.MustParse(tt.want) || got.Rate != money.MustParse(tt.wantRate) {
+				t.Errorf("Convert() = %s at %s, want %s at %s", got.Price, got.Rate, tt.want, tt.wantRate)
+			}
+		})
+	}
+}
@@ -8,10 +8,19 @@ import (
 	"time"
 )
 
-func RunMigrations(db *sql.DB, migrationsDir string) error {
+const (
+	// VersionTable records the migrations shared by both databases.
+	VersionTable = "goose_db_version"
+	// ReadVersionTable records the migrations of the read database alone.
+	ReadVersionTable = "goose_db_version_read"
+)
+
+// RunMigrations applies the migrations in migrationsDir and records them in
+// versionTable. Each set of migrations needs a table of its own.
+func RunMigrations(db *sql.DB, migrationsDir, versionTable string) error {
 	var err error
 	for i := 0; i < 5; i++ {
-		err = runMigrationsOnce(db, migrationsDir)
+		err = runMigrationsOnce(db, migrationsDir, versionTable)
 		if err == nil {
 			return nil
 		}
@@ -21,11 +30,12 @@ func RunMigrations(db *sql.DB, migrationsDir string) error {
 	return err
 }
 
-func runMigrationsOnce(db *sql.DB, migrationsDir string) error {
+func runMigrationsOnce(db *sql.DB, migrationsDir, versionTable string) error {
 	goose.SetBaseFS(nil) // Use the local filesystem
 	if err := goose.SetDialect("postgres"); err != nil {
 		return err
 	}
+	goose.SetTableName(versionTable)
 
 	if err := goose.Up(db, migrationsDir); err != nil {
 		return err
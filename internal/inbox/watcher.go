@@ -0,0 +1,273 @@
+package inbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/config"
+	"github.com/sh3ll3y/promotion-service/internal/csv"
+	"github.com/sh3ll3y/promotion-service/internal/jobs"
+	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	// markerSuffix marks a file as completely written in marker mode.
+	markerSuffix = ".done"
+
+	processingDir = "processing"
+	processedDir  = "processed"
+	failedDir     = "failed"
+)
+
+// Watcher polls an inbox directory and ingests every file dropped into it.
+// A file that is ready is moved to processing/ and queued as a job; once the
+// job has finished it is moved to processed/ or failed/ together with a
+// report of the job.
+type Watcher struct {
+	ctx        context.Context
+	cfg        config.InboxConfig
+	jobManager *jobs.Manager
+	// seen tracks the files in the inbox that are not ready yet
+	seen map[string]fileState
+	// pending maps the files in processing/ to their job, which is empty
+	// until the job has been queued
+	pending map[string]string
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// report is written next to a file once its job has finished.
+type report struct {
+	*models.Job
+	Source       string `json:"source"`
+	RejectReport string `json:"reject_report,omitempty"`
+}
+
+func NewWatcher(cfg config.InboxConfig, jobManager *jobs.Manager) *Watcher {
+	return &Watcher{
+		cfg:        cfg,
+		jobManager: jobManager,
+		seen:       make(map[string]fileState),
+		pending:    make(map[string]string),
+	}
+}
+
+// Start creates the folders of the inbox and starts polling it. Files left
+// in processing/ by a previous run are picked up again; their jobs are found
+// by idempotency key, so they are not queued twice. Polling stops when ctx is
+// cancelled.
+func (w *Watcher) Start(ctx context.Context) error {
+	if w.cfg.Ready != "marker" && w.cfg.Ready != "stable" {
+		return fmt.Errorf("unknown inbox ready mode %q", w.cfg.Ready)
+	}
+	if w.cfg.PollInterval <= 0 {
+		return fmt.Errorf("invalid inbox poll interval %s", w.cfg.PollInterval)
+	}
+	for _, dir := range []string{processingDir, processedDir, failedDir} {
+		if err := os.MkdirAll(filepath.Join(w.cfg.Dir, dir), 0o755); err != nil {
+			return fmt.Errorf("failed to create inbox folder: %w", err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(w.cfg.Dir, processingDir))
+	if err != nil {
+		return fmt.Errorf("failed to read inbox: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			w.pending[entry.Name()] = ""
+		}
+	}
+
+	logging.Logger.Info("Watching inbox", zap.String("dir", w.cfg.Dir), zap.String("ready", w.cfg.Ready))
+	w.ctx = ctx
+	go w.run()
+	return nil
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.poll()
+		select {
+		case <-ticker.C:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) poll() {
+	for name, jobID := range w.pending {
+		if jobID == "" {
+			w.submit(name)
+		} else {
+			w.check(name, jobID)
+		}
+	}
+
+	entries, err := os.ReadDir(w.cfg.Dir)
+	if err != nil {
+		logging.Logger.Error("Failed to read inbox", zap.Error(err), zap.String("dir", w.cfg.Dir))
+		return
+	}
+
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		present[name] = true
+		// Skip folders, hidden files, which are often still being
+		// written, and markers
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, markerSuffix) {
+			continue
+		}
+		if w.ready(name, entry) {
+			w.claim(name)
+		}
+	}
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+}
+
+// ready tells whether a file in the inbox has been completely written.
+func (w *Watcher) ready(name string, entry os.DirEntry) bool {
+	if w.cfg.Ready == "marker" {
+		_, err := os.Stat(filepath.Join(w.cfg.Dir, name+markerSuffix))
+		return err == nil
+	}
+
+	info, err := entry.Info()
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	state, ok := w.seen[name]
+	if !ok || state.size != info.Size() || !state.modTime.Equal(info.ModTime()) {
+		w.seen[name] = fileState{size: info.Size(), modTime: info.ModTime(), since: now}
+		return false
+	}
+	return now.Sub(state.since) >= w.cfg.SettleTime
+}
+
+// claim moves a ready file to processing/, prefixed with the time it was
+// claimed so that a file dropped again under the same name is a new file.
+func (w *Watcher) claim(name string) {
+	claimed := time.Now().UTC().Format("20060102T150405.000Z") + "-" + name
+	err := os.Rename(filepath.Join(w.cfg.Dir, name), filepath.Join(w.cfg.Dir, processingDir, claimed))
+	if err != nil {
+		logging.Logger.Error("Failed to claim inbox file", zap.Error(err), zap.String("file", name))
+		return
+	}
+	delete(w.seen, name)
+	if w.cfg.Ready == "marker" {
+		os.Remove(filepath.Join(w.cfg.Dir, name+markerSuffix))
+	}
+
+	w.pending[claimed] = ""
+	w.submit(claimed)
+}
+
+func (w *Watcher) submit(name string) {
+	request := &models.Job{
+		Source:         filepath.Join(w.cfg.Dir, processingDir, name),
+		Profile:        w.cfg.Profile,
+		Format:         string(csv.FormatFromFilename(name)),
+		Mode:           w.cfg.Mode,
+		IdempotencyKey: "inbox:" + name,
+	}
+	if request.Format == "" {
+		request.Format = string(csv.FormatCSV)
+	}
+
+	job, err := w.jobManager.Submit(w.ctx, request)
+	if err != nil {
+		logging.Logger.Error("Failed to queue inbox file, will retry", zap.Error(err), zap.String("file", name))
+		return
+	}
+	w.pending[name] = job.ID
+	logging.Logger.Info("Queued inbox file", zap.String("file", name), zap.String("job_id", job.ID))
+}
+
+// check moves a file out of processing/ once its job has finished.
+func (w *Watcher) check(name, jobID string) {
+	job, err := w.jobManager.Get(jobID)
+	if err != nil {
+		logging.Logger.Warn("Failed to get inbox job", zap.Error(err), zap.String("job_id", jobID))
+		return
+	}
+	if !job.Finished() {
+		return
+	}
+
+	dir := processedDir
+	if job.State != models.JobSucceeded {
+		dir = failedDir
+	}
+	path := filepath.Join(w.cfg.Dir, dir, name)
+	if err := os.Rename(job.Source, path); err != nil {
+		logging.Logger.Error("Failed to move inbox file", zap.Error(err), zap.String("file", name))
+		return
+	}
+	delete(w.pending, name)
+
+	if err := writeReport(path, job); err != nil {
+		logging.Logger.Error("Failed to write inbox report", zap.Error(err), zap.String("file", name))
+	}
+	logging.Logger.Info("Finished inbox file", zap.String("file", path), zap.String("state", string(job.State)))
+}
+
+// writeReport writes the job of a file to <file>.report.json, and copies its
+// rejected rows to <file>.rejects.csv.
+func writeReport(path string, job *models.Job) error {
+	r := report{Job: job, Source: path}
+	if job.RejectReport != "" {
+		r.RejectReport = path + ".rejects.csv"
+		if err := copyFile(job.RejectReport, r.RejectReport); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path+".report.json", b, 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open reject report: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create reject report copy: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy reject report: %w", err)
+	}
+	return out.Close()
+}
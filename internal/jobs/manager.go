@@ -0,0 +1,527 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/csv"
+	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/repository"
+	"github.com/sh3ll3y/promotion-service/internal/service"
+	"go.uber.org/zap"
+)
+
+const (
+	pollInterval     = 5 * time.Second
+	progressInterval = time.Second
+	// leaseTimeout is how long a running job whose owner has stopped
+	// recording its progress is left alone before it is recovered
+	leaseTimeout = 30 * time.Second
+	// maxAttempts limits how often a job interrupted by a restart is resumed
+	maxAttempts = 3
+)
+
+var (
+	// ErrIdempotencyKeyReused is returned when an idempotency key is sent
+	// again with a different request.
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used for a different request")
+	// ErrNotCancellable is returned when cancelling a job that has finished
+	// or that is not running in this process.
+	ErrNotCancellable = errors.New("job cannot be cancelled")
+
+	errCancelled = errors.New("cancelled")
+	errShutdown  = errors.New("service is shutting down")
+	errLeaseLost = errors.New("job was recovered by another instance")
+)
+
+// Manager runs ingestion jobs in the background. Jobs are queued in the write
+// database and executed one at a time across all instances, under the load
+// lock, since every load replaces or modifies the write-side dataset.
+type Manager struct {
+	repo *repository.JobRepository
+	// owner identifies this instance in the jobs it runs
+	owner     string
+	service   *service.PromotionService
+	reportDir string
+	wake      chan struct{}
+	// shutdown is closed to stop claiming jobs, stopped once the worker has
+	// returned
+	shutdown chan struct{}
+	stopped  chan struct{}
+
+	mu sync.Mutex
+	// progress holds the latest progress of the jobs running in this process
+	progress map[string]Progress
+	// cancels holds the cancel functions of the jobs running in this process
+	cancels map[string]context.CancelCauseFunc
+}
+
+// Progress is a snapshot of a job. Throughput and ETA are only known for a
+// job that is running in this process, the ETA only if the size of its input
+// is known.
+type Progress struct {
+	State         models.JobState `json:"state"`
+	RowsRead      int64           `json:"rows_read"`
+	RowsWritten   int64           `json:"rows_written"`
+	RowsRejected  int64           `json:"rows_rejected"`
+	BytesRead     int64           `json:"bytes_read,omitempty"`
+	BytesTotal    int64           `json:"bytes_total,omitempty"`
+	RowsPerSecond float64         `json:"rows_per_second"`
+	ETASeconds    *float64        `json:"eta_seconds,omitempty"`
+}
+
+func NewManager(repo *repository.JobRepository, service *service.PromotionService, reportDir string) *Manager {
+	return &Manager{
+		repo:      repo,
+		owner:     newOwner(),
+		service:   service,
+		reportDir: reportDir,
+		wake:      make(chan struct{}, 1),
+		shutdown:  make(chan struct{}),
+		stopped:   make(chan struct{}),
+		progress:  make(map[string]Progress),
+		cancels:   make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// newOwner returns an ID for this instance that is unique across restarts.
+func newOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Start recovers interrupted jobs and starts the worker. Jobs still queued
+// from a previous run are picked up by the worker.
+func (m *Manager) Start() error {
+	if err := m.recover(); err != nil {
+		return err
+	}
+	go m.run()
+	return nil
+}
+
+// recover requeues the running jobs whose lease has expired, because the
+// instance running them stopped, so that they resume from their last
+// checkpoint. Jobs that have been interrupted too often are failed instead.
+// Jobs that a live instance is running keep renewing their lease and are
+// left alone.
+func (m *Manager) recover() error {
+	requeued, err := m.repo.RequeueExpiredJobs(leaseTimeout, maxAttempts)
+	if err != nil {
+		return fmt.Errorf("failed to requeue interrupted jobs: %w", err)
+	}
+	for _, job := range requeued {
+		logging.Logger.Info("Requeued interrupted job", zap.String("job_id", job.ID), zap.Int("attempts", job.Attempts))
+	}
+
+	interrupted, err := m.repo.FailExpiredJobs(leaseTimeout, "interrupted too often")
+	if err != nil {
+		return fmt.Errorf("failed to fail interrupted jobs: %w", err)
+	}
+	for _, job := range interrupted {
+		logging.Logger.Warn("Marked interrupted job as failed", zap.String("job_id", job.ID))
+		m.discard(job)
+		m.cleanup(job)
+	}
+	return nil
+}
+
+// Submit queues a job. A request repeating the idempotency key of an earlier
+// one returns the earlier job instead. An upload identical to the current
+// dataset is recorded as an unchanged job that is never run.
+func (m *Manager) Submit(ctx context.Context, request *models.Job) (*models.Job, error) {
+	if request.IdempotencyKey != "" {
+		job, err := m.repo.GetJobByIdempotencyKey(request.IdempotencyKey)
+		if err == nil {
+			return m.replay(job, request)
+		}
+		if !errors.Is(err, repository.ErrJobNotFound) {
+			return nil, err
+		}
+	}
+
+	if request.SHA256 != "" {
+		current, err := m.service.UnchangedDataset(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil {
+			request.DatasetID = current.ID
+			request.Unchanged = true
+		}
+	}
+
+	job, err := m.repo.CreateJob(request)
+	if errors.Is(err, repository.ErrIdempotencyKeyExists) {
+		// A concurrent request with the same key got there first
+		if job, err = m.repo.GetJobByIdempotencyKey(request.IdempotencyKey); err != nil {
+			return nil, err
+		}
+		return m.replay(job, request)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Unchanged {
+		m.cleanup(job)
+		logging.Logger.Info("Upload is identical to the current dataset, skipping load", zap.String("job_id", job.ID),
+			zap.String("dataset_id", job.DatasetID))
+		return job, nil
+	}
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+
+	logging.Logger.Info("Queued ingestion job", zap.String("job_id", job.ID), zap.String("source", job.Source),
+		zap.String("profile", job.Profile), zap.String("format", job.Format), zap.String("mode", job.Mode))
+	return job, nil
+}
+
+// replay returns the job an idempotency key was first used for, after
+// checking that the request repeats the one that created it. The upload of
+// the repeated request is not needed.
+func (m *Manager) replay(job, request *models.Job) (*models.Job, error) {
+	same := job.Profile == request.Profile && job.Format == request.Format && job.Mode == request.Mode && job.Spooled == request.Spooled
+	if request.Spooled {
+		same = same && job.SHA256 == request.SHA256
+	} else {
+		same = same && job.Source == request.Source
+	}
+	if !same {
+		return nil, ErrIdempotencyKeyReused
+	}
+
+	m.cleanup(request)
+	logging.Logger.Info("Replayed ingestion job for idempotency key", zap.String("job_id", job.ID))
+	return job, nil
+}
+
+func (m *Manager) Get(id string) (*models.Job, error) {
+	return m.repo.GetJob(id)
+}
+
+// Cancel cancels a job. A queued job is cancelled right away. A running job
+// is cancelled asynchronously: its load is aborted and what it staged is
+// discarded, leaving the published dataset as it was.
+func (m *Manager) Cancel(id string) (*models.Job, error) {
+	job, err := m.repo.CancelQueuedJob(id)
+	if err == nil {
+		m.cleanup(job)
+		logging.Logger.Info("Cancelled queued ingestion job", zap.String("job_id", job.ID))
+		return job, nil
+	}
+	if !errors.Is(err, repository.ErrJobNotFound) {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	cancel, ok := m.cancels[id]
+	m.mu.Unlock()
+	if ok {
+		cancel(errCancelled)
+		logging.Logger.Info("Cancelling ingestion job", zap.String("job_id", id))
+		return m.repo.GetJob(id)
+	}
+
+	job, err = m.repo.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Finished() {
+		return nil, fmt.Errorf("%w: it has already %s", ErrNotCancellable, job.State)
+	}
+	return nil, fmt.Errorf("%w: it is not running in this process", ErrNotCancellable)
+}
+
+// Shutdown stops claiming jobs and waits for the running job to finish. If
+// ctx expires first, the job is aborted and left running in the database, so
+// that it is resumed from its last checkpoint once its lease has expired.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	close(m.shutdown)
+	select {
+	case <-m.stopped:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	for _, cancel := range m.cancels {
+		cancel(errShutdown)
+	}
+	m.mu.Unlock()
+	<-m.stopped
+	return ctx.Err()
+}
+
+// Progress returns the progress of a job, which is live if the job is
+// running in this process and otherwise as last recorded in the job.
+func (m *Manager) Progress(job *models.Job) Progress {
+	m.mu.Lock()
+	progress, ok := m.progress[job.ID]
+	m.mu.Unlock()
+	if ok && job.State == models.JobRunning {
+		return progress
+	}
+	return Progress{State: job.State, RowsRead: job.RowsRead, RowsWritten: job.RowsWritten, RowsRejected: job.RowsRejected}
+}
+
+func (m *Manager) run() {
+	defer close(m.stopped)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		default:
+		}
+
+		if err := m.recover(); err != nil {
+			logging.Logger.Error("Failed to recover interrupted jobs", zap.Error(err))
+		}
+		job, lock, err := m.claim()
+		if err != nil {
+			logging.Logger.Error("Failed to claim ingestion job", zap.Error(err))
+		}
+		if job != nil {
+			m.execute(job)
+			m.release(lock)
+			continue
+		}
+
+		select {
+		case <-m.wake:
+		case <-ticker.C:
+		case <-m.shutdown:
+			return
+		}
+	}
+}
+
+// claim takes the load lock and claims the next job. The lock is only kept
+// if there is a job to run; while another instance holds it, nothing is
+// claimed.
+func (m *Manager) claim() (*models.Job, *repository.LoadLock, error) {
+	lock, err := m.repo.TryLockLoads()
+	if err != nil || lock == nil {
+		return nil, nil, err
+	}
+	job, err := m.repo.ClaimNextJob(m.owner)
+	if err != nil || job == nil {
+		m.release(lock)
+		return nil, nil, err
+	}
+	return job, lock, nil
+}
+
+func (m *Manager) release(lock *repository.LoadLock) {
+	if err := lock.Release(); err != nil {
+		logging.Logger.Error("Failed to release load lock", zap.Error(err))
+	}
+}
+
+func (m *Manager) execute(job *models.Job) {
+	logging.Logger.Info("Starting ingestion job", zap.String("job_id", job.ID), zap.String("source", job.Source))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	m.mu.Lock()
+	m.cancels[job.ID] = cancel
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.cancels, job.ID)
+		m.mu.Unlock()
+		cancel(nil)
+	}()
+
+	stats := &csv.Stats{}
+	reportPath := filepath.Join(m.reportDir, "rejects-"+job.ID+".csv")
+	checkpoint, rejects, err := m.resume(ctx, job, reportPath)
+	if err != nil {
+		job.State = models.JobFailed
+		job.LastError = err.Error()
+		m.finish(job)
+		m.discard(job)
+		m.cleanup(job)
+		return
+	}
+
+	done := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		m.reportProgress(job.ID, stats, done, cancel)
+	}()
+
+	err = m.service.ProcessCSVFile(ctx, job, checkpoint, stats, rejects)
+	close(done)
+	<-reported
+
+	if err != nil && (errors.Is(context.Cause(ctx), errShutdown) || errors.Is(context.Cause(ctx), errLeaseLost)) {
+		// Keep the checkpoint, reject report and spool file for the resume
+		if closeErr := rejects.Close(); closeErr != nil {
+			logging.Logger.Error("Failed to write reject report", zap.Error(closeErr), zap.String("job_id", job.ID))
+		}
+		logging.Logger.Info("Interrupted ingestion job", zap.String("job_id", job.ID), zap.Error(context.Cause(ctx)))
+		return
+	}
+
+	job.RowsRead = stats.RowsRead.Load()
+	job.RowsWritten = stats.RowsWritten.Load()
+	job.RowsRejected = stats.RowsRejected.Load()
+	job.Duplicates = stats.Duplicates.Load()
+	job.RuleViolations = stats.RuleViolations()
+	job.State = models.JobSucceeded
+	if err != nil && errors.Is(context.Cause(ctx), errCancelled) {
+		job.State = models.JobCancelled
+		job.LastError = "cancelled"
+		// The job cannot be resumed, so drop what it staged
+		csv.RemoveRangeReports(reportPath)
+		m.discard(job)
+		logging.Logger.Info("Ingestion job cancelled", zap.String("job_id", job.ID))
+	} else if err != nil {
+		job.State = models.JobFailed
+		job.LastError = err.Error()
+		m.discard(job)
+		logging.Logger.Error("Ingestion job failed", zap.Error(err), zap.String("job_id", job.ID))
+	} else {
+		logging.Logger.Info("Ingestion job succeeded", zap.String("job_id", job.ID))
+	}
+
+	if closeErr := rejects.Close(); closeErr != nil {
+		logging.Logger.Error("Failed to write reject report", zap.Error(closeErr), zap.String("job_id", job.ID))
+	}
+	if job.RowsRejected > 0 {
+		job.RejectReport = reportPath
+	} else {
+		os.Remove(reportPath)
+	}
+
+	m.finish(job)
+	m.cleanup(job)
+}
+
+// resume looks up the checkpoint of a job and opens its reject report where
+// the checkpoint left it. Without a usable checkpoint the job starts over.
+func (m *Manager) resume(ctx context.Context, job *models.Job, reportPath string) (*models.Checkpoint, *csv.RejectReport, error) {
+	checkpoint, err := m.service.Checkpoint(ctx, job)
+	if err != nil {
+		logging.Logger.Warn("Failed to load checkpoint, starting over", zap.Error(err), zap.String("job_id", job.ID))
+		checkpoint = nil
+	}
+
+	if checkpoint != nil {
+		rejects, err := csv.OpenRejectReport(reportPath, checkpoint.RejectReportSize)
+		if err == nil {
+			return checkpoint, rejects, nil
+		}
+		logging.Logger.Warn("Failed to reopen reject report, starting over", zap.Error(err), zap.String("job_id", job.ID))
+	}
+
+	csv.RemoveRangeReports(reportPath)
+	rejects, err := csv.CreateRejectReport(reportPath)
+	return nil, rejects, err
+}
+
+func (m *Manager) finish(job *models.Job) {
+	if err := m.repo.FinishJob(job); errors.Is(err, repository.ErrLeaseLost) {
+		logging.Logger.Warn("Job was recovered by another instance, result not recorded", zap.String("job_id", job.ID))
+	} else if err != nil {
+		logging.Logger.Error("Failed to record job result", zap.Error(err), zap.String("job_id", job.ID))
+	}
+}
+
+// reportProgress records the progress of a running job every
+// progressInterval, in the job and for Progress, which renews the job's
+// lease. A job whose lease was lost is cancelled. Throughput is measured from
+// the first sample, since the counts of a resumed job start at its
+// checkpoint.
+func (m *Manager) reportProgress(id string, stats *csv.Stats, done <-chan struct{}, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	defer func() {
+		m.mu.Lock()
+		delete(m.progress, id)
+		m.mu.Unlock()
+	}()
+
+	var first Progress
+	var firstAt time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			progress := Progress{
+				State:        models.JobRunning,
+				RowsRead:     stats.RowsRead.Load(),
+				RowsWritten:  stats.RowsWritten.Load(),
+				RowsRejected: stats.RowsRejected.Load(),
+				BytesRead:    stats.BytesRead.Load(),
+				BytesTotal:   stats.BytesTotal.Load(),
+			}
+			if firstAt.IsZero() {
+				first, firstAt = progress, now
+			} else {
+				elapsed := now.Sub(firstAt).Seconds()
+				progress.RowsPerSecond = float64(progress.RowsRead-first.RowsRead) / elapsed
+				bytesPerSecond := float64(progress.BytesRead-first.BytesRead) / elapsed
+				if progress.BytesTotal > 0 && bytesPerSecond > 0 {
+					eta := float64(progress.BytesTotal-progress.BytesRead) / bytesPerSecond
+					if eta < 0 {
+						eta = 0
+					}
+					progress.ETASeconds = &eta
+				}
+			}
+			m.mu.Lock()
+			m.progress[id] = progress
+			m.mu.Unlock()
+
+			err := m.repo.UpdateJobProgress(id, m.owner, progress.RowsRead, progress.RowsWritten, progress.RowsRejected)
+			if errors.Is(err, repository.ErrLeaseLost) {
+				logging.Logger.Warn("Lost the lease of a running job", zap.String("job_id", id))
+				cancel(errLeaseLost)
+				return
+			}
+			if err != nil {
+				logging.Logger.Warn("Failed to update job progress", zap.Error(err), zap.String("job_id", id))
+			}
+		}
+	}
+}
+
+// discard drops what a job that can no longer run has staged. Staged rows
+// belong to their job, so nothing else clears them.
+func (m *Manager) discard(job *models.Job) {
+	if err := m.service.DiscardStagedLoad(context.Background(), job); err != nil {
+		logging.Logger.Error("Failed to discard staged load", zap.Error(err), zap.String("job_id", job.ID))
+	}
+}
+
+// cleanup removes the spool file of an uploaded job once it can no longer run.
+func (m *Manager) cleanup(job *models.Job) {
+	if !job.Spooled {
+		return
+	}
+	if err := os.Remove(job.Source); err != nil && !os.IsNotExist(err) {
+		logging.Logger.Warn("Failed to remove spooled upload", zap.Error(err), zap.String("path", job.Source))
+	}
+}
@@ -1,51 +1,79 @@
 package kafka
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/IBM/sarama"
 	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/repository"
 	"github.com/sh3ll3y/promotion-service/internal/service"
 	"go.uber.org/zap"
 )
 
+// Consumer applies the events of every load to the read DB. Each instance
+// consumes all events, but publishes them under the load lock, so only one
+// instance at a time syncs the read DB and the others find it synced.
 type Consumer struct {
 	consumer sarama.Consumer
 	topic    string
 	service  *service.PromotionService
+	jobRepo  *repository.JobRepository
 }
 
-func NewConsumer(brokers []string, topic string, service *service.PromotionService) (*Consumer, error) {
+func NewConsumer(brokers []string, topic string, service *service.PromotionService, jobRepo *repository.JobRepository) (*Consumer, error) {
 	config := sarama.NewConfig()
 	consumer, err := sarama.NewConsumer(brokers, config)
 	if err != nil {
 		return nil, err
 	}
-	return &Consumer{consumer: consumer, topic: topic, service: service}, nil
+	return &Consumer{consumer: consumer, topic: topic, service: service, jobRepo: jobRepo}, nil
 }
 
-func (c *Consumer) Start() error {
+// Start consumes events until ctx is cancelled, which also aborts the
+// read-side sync in progress.
+func (c *Consumer) Start(ctx context.Context) error {
 	partitionConsumer, err := c.consumer.ConsumePartition(c.topic, 0, sarama.OffsetNewest)
 	if err != nil {
 		return err
 	}
+	go func() {
+		<-ctx.Done()
+		partitionConsumer.AsyncClose()
+	}()
 
 	for message := range partitionConsumer.Messages() {
-		var event struct {
-			Type string `json:"type"`
-		}
+		var event event
 		err := json.Unmarshal(message.Value, &event)
 		if err != nil {
 			logging.Logger.Error("Failed to unmarshal event", zap.Error(err))
 			continue
 		}
 
-		if event.Type == "NewFileLoaded" {
-			err := c.service.UpdateReadDB()
-			if err != nil {
-				logging.Logger.Error("Failed to update read DB", zap.Error(err))
-			}
+		lock, err := c.jobRepo.LockLoads(ctx)
+		if err != nil {
+			logging.Logger.Error("Failed to lock read DB publish", zap.Error(err), zap.String("dataset_id", event.DatasetID))
+			continue
+		}
+		c.handle(ctx, event)
+		if err := lock.Release(); err != nil {
+			logging.Logger.Error("Failed to release load lock", zap.Error(err))
 		}
 	}
 
 	return nil
+}
+
+func (c *Consumer) handle(ctx context.Context, event event) {
+	switch event.Type {
+	case "NewFileLoaded":
+		err := c.service.UpdateReadDB(ctx, event.DatasetID)
+		if err != nil {
+			logging.Logger.Error("Failed to update read DB", zap.Error(err))
+		}
+	case "PromotionsChanged":
+		err := c.service.ApplyChangesToReadDB(ctx, event.ChangeSet, event.DatasetID)
+		if err != nil {
+			logging.Logger.Error("Failed to apply changes to read DB", zap.Error(err), zap.String("change_set", event.ChangeSet))
+		}
+	}
 }
\ No newline at end of file
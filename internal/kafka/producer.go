@@ -20,13 +20,24 @@ func NewProducer(brokers []string, topic string) (*Producer, error) {
 	return &Producer{producer: producer, topic: topic}, nil
 }
 
-func (p *Producer) PublishNewFileLoadedEvent() error {
-	event := struct {
-		Type string `json:"type"`
-	}{
-		Type: "NewFileLoaded",
-	}
+func (p *Producer) PublishNewFileLoadedEvent(datasetID string) error {
+	return p.publish(event{Type: "NewFileLoaded", DatasetID: datasetID})
+}
+
+// PublishPromotionsChangedEvent announces a delta load. The event only carries
+// the change set; the read side pulls the changed promotions.
+func (p *Producer) PublishPromotionsChangedEvent(changeSet, datasetID string) error {
+	return p.publish(event{Type: "PromotionsChanged", ChangeSet: changeSet, DatasetID: datasetID})
+}
+
+// event is a load announced to the read side, with the dataset it published.
+type event struct {
+	Type      string `json:"type"`
+	ChangeSet string `json:"change_set,omitempty"`
+	DatasetID string `json:"dataset_id"`
+}
 
+func (p *Producer) publish(event event) error {
 	eventJSON, err := json.Marshal(event)
 	if err != nil {
 		return err
@@ -11,6 +11,11 @@ var (
 		Help: "The total number of processed lines from CSV",
 	})
 
+	DuplicateIDs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "csv_duplicate_ids_total",
+		Help: "The total number of rows dropped because their ID repeats an earlier row",
+	}, []string{"mode", "policy"})
+
 	DatabaseOperations = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "database_operations_total",
 		Help: "The total number of database operations",
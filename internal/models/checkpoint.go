@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// Checkpoint records how far an ingestion job has got through its file.
+// Every record before Offset has been committed to staging or rejected, so a
+// restarted job can continue from there.
+type Checkpoint struct {
+	JobID string
+	// Fingerprint identifies the file, so that a changed file is not resumed.
+	Fingerprint string
+	// Offset is the byte offset in the decompressed input and Line the last
+	// line consumed.
+	Offset int64
+	Line   int
+	// Header is the header record of the file, if it has one.
+	Header           []string
+	RowsRead         int64
+	RowsWritten      int64
+	RowsRejected     int64
+	RejectReportSize int64
+	RuleViolations   []RuleViolation
+	UpdatedAt        time.Time
+	// Range is set on the checkpoint of a byte range of a split load.
+	Range *ByteRange
+	// Ranges holds the checkpoints of the byte ranges of a split load. The
+	// row counts of the load are their sums; Offset and Line are unused.
+	Ranges []Checkpoint
+}
+
+// ByteRange is a part of a file that is parsed concurrently with the other
+// parts. It starts at a record boundary, and its lines are counted from its
+// start.
+type ByteRange struct {
+	Index int
+	Start int64
+	End   int64
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+type DatasetStatus string
+
+const (
+	// DatasetLoaded is a dataset in the write DB that the read side has not
+	// caught up with yet.
+	DatasetLoaded DatasetStatus = "loaded"
+	// DatasetPublished is a dataset that is served by the read side.
+	DatasetPublished DatasetStatus = "published"
+	// DatasetSuperseded is a dataset that a later full load replaced.
+	DatasetSuperseded DatasetStatus = "superseded"
+)
+
+// Dataset records a load that was published to the write DB, and when the
+// read side published it in turn. ChangeSet and BaseID are set for delta
+// loads. Rows counts the rows of the load itself and TotalRows the promotions
+// once it has been applied.
+type Dataset struct {
+	ID          string        `json:"id"`
+	JobID       string        `json:"job_id"`
+	Source      string        `json:"source"`
+	SHA256      string        `json:"sha256"`
+	Profile     string        `json:"profile"`
+	Format      string        `json:"format"`
+	Mode        string        `json:"mode"`
+	Rows        int64         `json:"rows"`
+	TotalRows   int64         `json:"total_rows"`
+	BaseID      string        `json:"base_id,omitempty"`
+	ChangeSet   string        `json:"change_set,omitempty"`
+	Status      DatasetStatus `json:"status"`
+	LoadedAt    time.Time     `json:"loaded_at"`
+	PublishedAt *time.Time    `json:"published_at,omitempty"`
+}
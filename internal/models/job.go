@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+type Job struct {
+	ID      string   `json:"id"`
+	State   JobState `json:"state"`
+	Source  string   `json:"source"`
+	Profile string   `json:"profile,omitempty"`
+	Format  string   `json:"format"`
+	Mode    string   `json:"mode"`
+	Spooled bool     `json:"-"`
+	// SHA256 is the checksum of the input file as it was received.
+	SHA256         string `json:"sha256,omitempty"`
+	IdempotencyKey string `json:"-"`
+	// DatasetID is the dataset the job published, or the current dataset
+	// if the file was unchanged and nothing was loaded.
+	DatasetID    string `json:"dataset_id,omitempty"`
+	Unchanged    bool   `json:"unchanged,omitempty"`
+	RowsRead     int64  `json:"rows_read"`
+	RowsWritten  int64  `json:"rows_written"`
+	RowsRejected int64  `json:"rows_rejected"`
+	Duplicates   int64  `json:"duplicates"`
+	// RuleViolations counts the rows that broke each business rule.
+	RuleViolations []RuleViolation `json:"rule_violations,omitempty"`
+	Attempts       int             `json:"attempts"`
+	CreatedAt      time.Time       `json:"created_at"`
+	StartedAt      *time.Time      `json:"started_at,omitempty"`
+	FinishedAt     *time.Time      `json:"finished_at,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	RejectReport   string          `json:"-"`
+	// Owner is the instance that runs the job.
+	Owner string `json:"-"`
+}
+
+// Finished tells whether the job has reached a final state.
+func (j *Job) Finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobCancelled
+}
+
+// RuleViolation counts the rows of a load that broke a business rule.
+type RuleViolation struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Rows     int64  `json:"rows"`
+}
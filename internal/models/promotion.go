@@ -1,9 +1,119 @@
 package models
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
 
+	"github.com/sh3ll3y/promotion-service/internal/money"
+)
+
+// PriceScale is the number of decimal places prices are stored with.
+const PriceScale = 2
+
+// MinPrice and MaxPrice bound the prices the DECIMAL(10, 2) columns hold.
+var (
+	MinPrice = money.New(-9999999999, PriceScale)
+	MaxPrice = money.New(9999999999, PriceScale)
+)
+
+// Promotion is valid from StartsAt, or right away if it has no start, until
+// ExpirationDate.
 type Promotion struct {
-	ID             string    `json:"id"`
-	Price          float64   `json:"price"`
-	ExpirationDate time.Time `json:"expiration_date"`
-}
\ No newline at end of file
+	ID             string       `json:"id"`
+	Price          money.Amount `json:"price"`
+	Currency       string       `json:"currency"`
+	StartsAt       *time.Time   `json:"starts_at,omitempty"`
+	ExpirationDate time.Time    `json:"expiration_date"`
+	Metadata       Metadata     `json:"metadata,omitempty"`
+}
+
+// Metadata holds the attributes of a promotion, such as its SKU or channel,
+// and is stored as a JSONB object.
+type Metadata map[string]string
+
+// Value writes the metadata as JSON text; without attributes it is an empty
+// object.
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (m *Metadata) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into metadata", src)
+	}
+	var metadata Metadata
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return err
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	*m = metadata
+	return nil
+}
+
+type PromotionStatus string
+
+const (
+	StatusScheduled PromotionStatus = "scheduled"
+	StatusActive    PromotionStatus = "active"
+	StatusExpired   PromotionStatus = "expired"
+)
+
+// Status returns the lifecycle status of the promotion at the given time.
+func (p *Promotion) Status(now time.Time) PromotionStatus {
+	switch {
+	case !now.Before(p.ExpirationDate):
+		return StatusExpired
+	case p.StartsAt != nil && now.Before(*p.StartsAt):
+		return StatusScheduled
+	}
+	return StatusActive
+}
+
+type Operation string
+
+const (
+	OperationUpsert Operation = "upsert"
+	OperationDelete Operation = "delete"
+)
+
+// PromotionRecord is a promotion as read from an input file, with the line it
+// came from and, in delta loads, the operation to apply. Deletes only carry
+// the ID.
+type PromotionRecord struct {
+	Promotion
+	Line      int
+	Operation Operation
+}
+
+// DuplicatePolicy decides which row wins when a full load repeats an ID.
+type DuplicatePolicy string
+
+const (
+	// DuplicateReject fails the load.
+	DuplicateReject DuplicatePolicy = "reject"
+	DuplicateFirst  DuplicatePolicy = "first"
+	DuplicateLast   DuplicatePolicy = "last"
+	// DuplicateLowestPrice keeps the row with the lowest price, and the first
+	// of those on a tie. The prices of an ID must share a currency.
+	DuplicateLowestPrice DuplicatePolicy = "lowest_price"
+)
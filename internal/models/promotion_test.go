@@ -0,0 +1,39 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromotionStatus(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		startsAt *time.Time
+		now      time.Time
+		want     PromotionStatus
+	}{
+		{name: "before start", startsAt: &start, now: start.Add(-time.Nanosecond), want: StatusScheduled},
+		{name: "at start", startsAt: &start, now: start, want: StatusActive},
+		{name: "before expiration", startsAt: &start, now: end.Add(-time.Nanosecond), want: StatusActive},
+		{name: "at expiration", startsAt: &start, now: end, want: StatusExpired},
+		{name: "after expiration", startsAt: &start, now: end.Add(time.Hour), want: StatusExpired},
+		{name: "no start", now: start.Add(-24 * time.Hour), want: StatusActive},
+		{name: "no start at expiration", now: end, want: StatusExpired},
+		// A start in another zone is the same instant
+		{name: "start in another zone", startsAt: ptr(start.In(time.FixedZone("UTC+2", 2*60*60))), now: start.Add(-time.Second), want: StatusScheduled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Promotion{StartsAt: tt.startsAt, ExpirationDate: end}
+			if got := p.Status(tt.now); got != tt.want {
+				t.Errorf("Status(%v) = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,362 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrPrecision is returned for amounts with more significant digits than
+	// an Amount holds.
+	ErrPrecision = errors.New("amount has too many digits")
+	// ErrInexact is returned when RoundExact would have to round an amount.
+	ErrInexact = errors.New("amount cannot be rounded exactly")
+)
+
+const (
+	// maxDigits is how many significant digits an Amount holds.
+	maxDigits = 18
+	// maxScale is how many decimal places an Amount holds.
+	maxScale = 64
+)
+
+var pow10 = func() [maxDigits + 1]int64 {
+	var p [maxDigits + 1]int64
+	p[0] = 1
+	for i := 1; i <= maxDigits; i++ {
+		p[i] = p[i-1] * 10
+	}
+	return p
+}()
+
+// Amount is an exact decimal amount: coef scaled down by scale decimal
+// places. Amounts are normalized without trailing fractional zeros, so equal
+// amounts compare equal with ==. The zero value is 0.
+type Amount struct {
+	coef  int64
+	scale int32
+}
+
+// New returns coef scaled down by scale decimal places, e.g. New(1999, 2)
+// for 19.99. The scale must not be negative.
+func New(coef int64, scale int32) Amount {
+	return normalize(coef, scale)
+}
+
+// Parse reads a decimal amount such as "19.99", "-0.5" or "1.5e3" without
+// going through floating point.
+func Parse(s string) (Amount, error) {
+	mantissa, exponent := s, int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.ParseInt(s[i+1:], 10, 32)
+		if err != nil {
+			return Amount{}, fmt.Errorf("invalid amount %q", s)
+		}
+		mantissa, exponent = s[:i], e
+	}
+
+	negative := false
+	if len(mantissa) > 0 && (mantissa[0] == '-' || mantissa[0] == '+') {
+		negative = mantissa[0] == '-'
+		mantissa = mantissa[1:]
+	}
+	whole, fraction, hasPoint := strings.Cut(mantissa, ".")
+	if whole == "" && fraction == "" || hasPoint && strings.Contains(fraction, ".") {
+		return Amount{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	var coef int64
+	digits := 0
+	for _, c := range whole + fraction {
+		if c < '0' || c > '9' {
+			return Amount{}, fmt.Errorf("invalid amount %q", s)
+		}
+		if coef == 0 && c == '0' {
+			continue
+		}
+		if digits++; digits > maxDigits {
+			return Amount{}, fmt.Errorf("%w: %q", ErrPrecision, s)
+		}
+		coef = coef*10 + int64(c-'0')
+	}
+	if negative {
+		coef = -coef
+	}
+
+	// Move a positive exponent into the coefficient
+	scale := int64(len(fraction)) - exponent
+	for ; scale < 0 && coef != 0; scale++ {
+		if digits++; digits > maxDigits {
+			return Amount{}, fmt.Errorf("%w: %q", ErrPrecision, s)
+		}
+		coef *= 10
+	}
+	if coef == 0 {
+		return Amount{}, nil
+	}
+	for scale > 0 && coef%10 == 0 {
+		coef /= 10
+		scale--
+	}
+	if scale > maxScale {
+		return Amount{}, fmt.Errorf("%w: %q", ErrPrecision, s)
+	}
+	return Amount{coef: coef, scale: int32(scale)}, nil
+}
+
+// MustParse is like Parse but panics on an invalid amount.
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func normalize(coef int64, scale int32) Amount {
+	if coef == 0 {
+		return Amount{}
+	}
+	for scale > 0 && coef%10 == 0 {
+		coef /= 10
+		scale--
+	}
+	return Amount{coef: coef, scale: scale}
+}
+
+// Decimals returns the number of decimal places of the amount.
+func (a Amount) Decimals() int {
+	return int(a.scale)
+}
+
+func (a Amount) IsZero() bool {
+	return a.coef == 0
+}
+
+// Sign returns -1, 0 or +1 as the amount is negative, zero or positive.
+func (a Amount) Sign() int {
+	switch {
+	case a.coef < 0:
+		return -1
+	case a.coef > 0:
+		return 1
+	}
+	return 0
+}
+
+// Cmp returns -1, 0 or +1 as a is less than, equal to or greater than b.
+func (a Amount) Cmp(b Amount) int {
+	if a.scale == b.scale {
+		switch {
+		case a.coef < b.coef:
+			return -1
+		case a.coef > b.coef:
+			return 1
+		}
+		return 0
+	}
+	scale := a.scale
+	if b.scale > scale {
+		scale = b.scale
+	}
+	return a.rescaled(scale).Cmp(b.rescaled(scale))
+}
+
+// rescaled returns the coefficient of the amount at a larger scale, which
+// may not fit into an int64.
+func (a Amount) rescaled(scale int32) *big.Int {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-a.scale)), nil)
+	return factor.Mul(factor, big.NewInt(a.coef))
+}
+
+func (a Amount) String() string {
+	s := strconv.FormatInt(a.coef, 10)
+	if a.scale <= 0 {
+		return s
+	}
+	sign := ""
+	if a.coef < 0 {
+		sign, s = "-", s[1:]
+	}
+	if pad := int(a.scale) - len(s) + 1; pad > 0 {
+		s = strings.Repeat("0", pad) + s
+	}
+	point := len(s) - int(a.scale)
+	return sign + s[:point] + "." + s[point:]
+}
+
+// RoundingMode decides how Round drops decimal places.
+type RoundingMode string
+
+const (
+	// RoundHalfUp rounds to the nearest amount, and away from zero on a tie.
+	RoundHalfUp RoundingMode = "half_up"
+	// RoundHalfEven rounds to the nearest amount, and to an even last digit
+	// on a tie.
+	RoundHalfEven RoundingMode = "half_even"
+	// RoundDown truncates towards zero.
+	RoundDown RoundingMode = "down"
+	// RoundExact does not round: Round fails with ErrInexact instead.
+	RoundExact RoundingMode = "exact"
+)
+
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch mode := RoundingMode(s); mode {
+	case RoundHalfUp, RoundHalfEven, RoundDown, RoundExact:
+		return mode, nil
+	case "":
+		return RoundHalfUp, nil
+	}
+	return "", fmt.Errorf("unknown rounding mode %q", s)
+}
+
+// Round returns the amount with at most scale decimal places.
+func (a Amount) Round(scale int32, mode RoundingMode) (Amount, error) {
+	if a.scale <= scale {
+		return a, nil
+	}
+	if mode == RoundExact {
+		return Amount{}, fmt.Errorf("%w: %s has more than %d decimals", ErrInexact, a, scale)
+	}
+	if a.scale-scale > maxDigits {
+		// Every digit of the coefficient is dropped
+		return Amount{}, nil
+	}
+
+	divisor := pow10[a.scale-scale]
+	quotient, remainder := a.coef/divisor, a.coef%divisor
+	if remainder < 0 {
+		remainder = -remainder
+	}
+	away := false
+	switch mode {
+	case RoundHalfUp:
+		away = remainder*2 >= divisor
+	case RoundHalfEven:
+		away = remainder*2 > divisor || remainder*2 == divisor && quotient%2 != 0
+	case RoundDown:
+	default:
+		return Amount{}, fmt.Errorf("unknown rounding mode %q", mode)
+	}
+	if away {
+		if a.coef < 0 {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+	return normalize(quotient, scale), nil
+}
+
+// MarshalJSON writes the amount as a JSON number with its exact digits.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON reads a JSON number or a string holding a number.
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	amount, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Scan reads a NUMERIC column, which the driver returns as text.
+func (a *Amount) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		*a = New(v, 0)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into an amount", src)
+	}
+	amount, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Value writes the amount as text, which Postgres reads into NUMERIC
+// exactly.
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// Mul returns a times b rounded to scale decimal places.
+func (a Amount) Mul(b Amount, scale int32, mode RoundingMode) (Amount, error) {
+	product := new(big.Rat).Mul(a.rat(), b.rat())
+	return fromRat(product, scale, mode)
+}
+
+// Quo returns a divided by b rounded to scale decimal places.
+func (a Amount) Quo(b Amount, scale int32, mode RoundingMode) (Amount, error) {
+	if b.IsZero() {
+		return Amount{}, errors.New("division by zero")
+	}
+	quotient := new(big.Rat).Quo(a.rat(), b.rat())
+	return fromRat(quotient, scale, mode)
+}
+
+// MulQuo returns a multiplied by b and divided by c, rounded once to scale
+// decimal places.
+func (a Amount) MulQuo(b, c Amount, scale int32, mode RoundingMode) (Amount, error) {
+	if c.IsZero() {
+		return Amount{}, errors.New("division by zero")
+	}
+	product := new(big.Rat).Mul(a.rat(), b.rat())
+	return fromRat(product.Quo(product, c.rat()), scale, mode)
+}
+
+func (a Amount) rat() *big.Rat {
+	denominator := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(a.scale)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(a.coef), denominator)
+}
+
+// fromRat rounds an exact result to scale decimal places.
+func fromRat(r *big.Rat, scale int32, mode RoundingMode) (Amount, error) {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	numerator := new(big.Int).Mul(r.Num(), factor)
+	quotient, remainder := new(big.Int).QuoRem(numerator, r.Denom(), new(big.Int))
+	if remainder.Sign() != 0 {
+		// Compare twice the remainder with the denominator to find ties
+		twice := new(big.Int).Lsh(new(big.Int).Abs(remainder), 1)
+		half := twice.Cmp(r.Denom())
+		away := false
+		switch mode {
+		case RoundHalfUp:
+			away = half >= 0
+		case RoundHalfEven:
+			away = half > 0 || half == 0 && quotient.Bit(0) != 0
+		case RoundDown:
+		case RoundExact:
+			return Amount{}, fmt.Errorf("%w: result has more than %d decimals", ErrInexact, scale)
+		default:
+			return Amount{}, fmt.Errorf("unknown rounding mode %q", mode)
+		}
+		if away {
+			quotient.Add(quotient, big.NewInt(int64(r.Sign())))
+		}
+	}
+	limit := big.NewInt(pow10[maxDigits])
+	if new(big.Int).Abs(quotient).Cmp(limit) >= 0 {
+		return Amount{}, fmt.Errorf("%w: result does not fit", ErrPrecision)
+	}
+	return normalize(quotient.Int64(), scale), nil
+}
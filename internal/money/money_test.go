@@ -0,0 +1,252 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{in: "19.99", want: "19.99"},
+		{in: "19.90", want: "19.9"},
+		{in: "-0.5", want: "-0.5"},
+		{in: "+7", want: "7"},
+		{in: "0.000", want: "0"},
+		{in: "-0", want: "0"},
+		{in: ".5", want: "0.5"},
+		{in: "5.", want: "5"},
+		{in: "1.5e3", want: "1500"},
+		{in: "-1.5E-3", want: "-0.0015"},
+		{in: "0e99", want: "0"},
+		{in: "000123.4500", want: "123.45"},
+		{in: "999999999999999999", want: "999999999999999999"},
+		{in: "-99999999.9999999999", want: "-99999999.9999999999"},
+		{in: "1000000000000000000", wantErr: ErrPrecision},
+		{in: "1.234567890123456789", wantErr: ErrPrecision},
+		{in: "1e18", wantErr: ErrPrecision},
+		{in: "1e-65", wantErr: ErrPrecision},
+		{in: ""},
+		{in: "."},
+		{in: "-"},
+		{in: "1.2.3"},
+		{in: "12a"},
+		{in: "1e"},
+		{in: "NaN"},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Parse(%q) = %s, want an error", tt.in, got)
+			} else if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Parse(%q) error = %v, want %v", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewNormalizes(t *testing.T) {
+	tests := []struct {
+		coef  int64
+		scale int32
+		want  Amount
+	}{
+		{coef: 1990, scale: 2, want: MustParse("19.9")},
+		{coef: -500, scale: 3, want: MustParse("-0.5")},
+		{coef: 0, scale: 5, want: Amount{}},
+		{coef: 42, scale: 0, want: MustParse("42")},
+	}
+	for _, tt := range tests {
+		if got := New(tt.coef, tt.scale); got != tt.want {
+			t.Errorf("New(%d, %d) = %s, want %s", tt.coef, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		in      string
+		scale   int32
+		mode    RoundingMode
+		want    string
+		wantErr error
+	}{
+		{in: "1.005", scale: 2, mode: RoundHalfUp, want: "1.01"},
+		{in: "1.005", scale: 2, mode: RoundHalfEven, want: "1"},
+		{in: "1.015", scale: 2, mode: RoundHalfEven, want: "1.02"},
+		{in: "1.0051", scale: 2, mode: RoundHalfEven, want: "1.01"},
+		{in: "1.009", scale: 2, mode: RoundDown, want: "1"},
+		{in: "-1.005", scale: 2, mode: RoundHalfUp, want: "-1.01"},
+		{in: "-1.005", scale: 2, mode: RoundHalfEven, want: "-1"},
+		{in: "-1.015", scale: 2, mode: RoundHalfEven, want: "-1.02"},
+		{in: "-1.009", scale: 2, mode: RoundDown, want: "-1"},
+		{in: "-0.004", scale: 2, mode: RoundHalfUp, want: "0"},
+		{in: "2.5", scale: 0, mode: RoundHalfEven, want: "2"},
+		{in: "3.5", scale: 0, mode: RoundHalfEven, want: "4"},
+		{in: "9.995", scale: 2, mode: RoundHalfUp, want: "10"},
+		{in: "19.99", scale: 2, mode: RoundExact, want: "19.99"},
+		{in: "19.9", scale: 2, mode: RoundDown, want: "19.9"},
+		{in: "19.999", scale: 2, mode: RoundExact, wantErr: ErrInexact},
+		{in: "0.000000000000000000005", scale: 0, mode: RoundHalfUp, want: "0"},
+		{in: "99999999.995", scale: 2, mode: RoundHalfUp, want: "100000000"},
+		{in: "1.5", scale: 0, mode: RoundingMode("up")},
+	}
+	for _, tt := range tests {
+		got, err := MustParse(tt.in).Round(tt.scale, tt.mode)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Round(%s, %d, %s) = %s, want an error", tt.in, tt.scale, tt.mode, got)
+			} else if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Round(%s, %d, %s) error = %v, want %v", tt.in, tt.scale, tt.mode, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Round(%s, %d, %s) error = %v", tt.in, tt.scale, tt.mode, err)
+			continue
+		}
+		if got != MustParse(tt.want) {
+			t.Errorf("Round(%s, %d, %s) = %s, want %s", tt.in, tt.scale, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestCmpAndSign(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "1.5", b: "1.50", want: 0},
+		{a: "1.49", b: "1.5", want: -1},
+		{a: "-1.5", b: "-1.49", want: -1},
+		{a: "0", b: "-0.01", want: 1},
+		{a: "999999999999999999", b: "0.000000000000000001", want: 1},
+		{a: "-999999999999999999", b: "0.999999999999999999", want: -1},
+	}
+	for _, tt := range tests {
+		if got := MustParse(tt.a).Cmp(MustParse(tt.b)); got != tt.want {
+			t.Errorf("Cmp(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := MustParse(tt.b).Cmp(MustParse(tt.a)); got != -tt.want {
+			t.Errorf("Cmp(%s, %s) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+
+	for in, want := range map[string]int{"-0.01": -1, "0": 0, "0.01": 1} {
+		if got := MustParse(in).Sign(); got != want {
+			t.Errorf("Sign(%s) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestMulQuo(t *testing.T) {
+	tests := []struct {
+		op      string
+		a, b, c string
+		scale   int32
+		mode    RoundingMode
+		want    string
+		wantErr error
+	}{
+		{op: "mul", a: "31.46", b: "1.0853", scale: 2, mode: RoundHalfEven, want: "34.14"},
+		{op: "mul", a: "0.125", b: "1", scale: 2, mode: RoundHalfEven, want: "0.12"},
+		{op: "mul", a: "0.125", b: "1", scale: 2, mode: RoundHalfUp, want: "0.13"},
+		{op: "mul", a: "-0.125", b: "1", scale: 2, mode: RoundHalfUp, want: "-0.13"},
+		{op: "mul", a: "-2.5", b: "-4", scale: 0, mode: RoundExact, want: "10"},
+		{op: "mul", a: "0.125", b: "1", scale: 2, mode: RoundExact, wantErr: ErrInexact},
+		{op: "mul", a: "999999999999999999", b: "10", scale: 0, mode: RoundDown, wantErr: ErrPrecision},
+		{op: "quo", a: "1", b: "3", scale: 4, mode: RoundHalfUp, want: "0.3333"},
+		{op: "quo", a: "2", b: "3", scale: 4, mode: RoundDown, want: "0.6666"},
+		{op: "quo", a: "-2", b: "3", scale: 4, mode: RoundHalfUp, want: "-0.6667"},
+		{op: "quo", a: "1", b: "8", scale: 2, mode: RoundHalfEven, want: "0.12"},
+		{op: "quo", a: "1", b: "0", scale: 2, mode: RoundHalfUp},
+		// Rounding 1/3 to 4 decimals first would give 2.9997
+		{op: "mulquo", a: "9", b: "1", c: "3", scale: 4, mode: RoundHalfUp, want: "3"},
+		{op: "mulquo", a: "1", b: "1", c: "8", scale: 2, mode: RoundHalfEven, want: "0.12"},
+		{op: "mulquo", a: "999999999999999999", b: "10", c: "100", scale: 0, mode: RoundDown, want: "99999999999999999"},
+		{op: "mulquo", a: "1", b: "1", c: "0", scale: 2, mode: RoundHalfUp},
+	}
+	for _, tt := range tests {
+		a, b := MustParse(tt.a), MustParse(tt.b)
+		var got Amount
+		var err error
+		switch tt.op {
+		case "mul":
+			got, err = a.Mul(b, tt.scale, tt.mode)
+		case "quo":
+			got, err = a.Quo(b, tt.scale, tt.mode)
+		case "mulquo":
+			got, err = a.MulQuo(b, MustParse(tt.c), tt.scale, tt.mode)
+		}
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s(%s, %s) = %s, want an error", tt.op, tt.a, tt.b, got)
+			} else if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s(%s, %s) error = %v, want %v", tt.op, tt.a, tt.b, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s(%s, %s) error = %v", tt.op, tt.a, tt.b, err)
+			continue
+		}
+		if got != MustParse(tt.want) {
+			t.Errorf("%s(%s, %s) = %s, want %s", tt.op, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestJSONAndScan(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: `19.99`, want: "19.99"},
+		{in: `"19.990"`, want: "19.99"},
+		{in: `-0.5`, want: "-0.5"},
+		{in: `1e2`, want: "100"},
+	}
+	for _, tt := range tests {
+		var a Amount
+		if err := json.Unmarshal([]byte(tt.in), &a); err != nil {
+			t.Errorf("Unmarshal(%s) error = %v", tt.in, err)
+			continue
+		}
+		b, err := json.Marshal(a)
+		if err != nil || string(b) != tt.want {
+			t.Errorf("Marshal(Unmarshal(%s)) = %s, %v, want %s", tt.in, b, err, tt.want)
+		}
+	}
+
+	scans := []struct {
+		src  interface{}
+		want string
+	}{
+		{src: []byte("19.90"), want: "19.9"},
+		{src: "-0.01", want: "-0.01"},
+		{src: int64(42), want: "42"},
+	}
+	for _, tt := range scans {
+		var a Amount
+		if err := a.Scan(tt.src); err != nil || a != MustParse(tt.want) {
+			t.Errorf("Scan(%v) = %s, %v, want %s", tt.src, a, err, tt.want)
+		}
+	}
+	var a Amount
+	if err := a.Scan(1.5); err == nil {
+		t.Error("Scan(float64) succeeded, want an error")
+	}
+}
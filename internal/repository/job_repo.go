@@ -0,0 +1,343 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	// ErrIdempotencyKeyExists is returned when a job with the same
+	// idempotency key has already been created.
+	ErrIdempotencyKeyExists = errors.New("idempotency key already used")
+	// ErrLeaseLost is returned when a job has been recovered from the
+	// instance that was running it, because its lease expired.
+	ErrLeaseLost = errors.New("job lease lost")
+)
+
+const jobColumns = `id, state, source, profile, format, mode, spooled, sha256, idempotency_key, dataset_id, unchanged,
+	rows_read, rows_written, rows_rejected, duplicates, rule_violations, attempts, created_at, started_at, finished_at,
+	last_error, reject_report, owner`
+
+// JobRepository persists ingestion jobs in the write database so that their
+// state survives restarts.
+type JobRepository struct {
+	db *sql.DB
+}
+
+func NewJobRepository(db *sql.DB) *JobRepository {
+	return &JobRepository{db: db}
+}
+
+// CreateJob stores a job for the source, profile, format, mode, spooled flag,
+// checksum and idempotency key of the given job and returns the stored job.
+// The job is queued unless it is already finished as unchanged. If its
+// idempotency key has been used before it returns ErrIdempotencyKeyExists.
+func (r *JobRepository) CreateJob(job *models.Job) (*models.Job, error) {
+	state := models.JobQueued
+	if job.Unchanged {
+		state = models.JobSucceeded
+	}
+	row := r.db.QueryRow(`
+		INSERT INTO ingestion_jobs (state, source, profile, format, mode, spooled, sha256, idempotency_key, dataset_id, unchanged, finished_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, '')::uuid, $10, CASE WHEN $10 THEN NOW() END)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+jobColumns,
+		state, job.Source, job.Profile, job.Format, job.Mode, job.Spooled, job.SHA256, job.IdempotencyKey, job.DatasetID, job.Unchanged,
+	)
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrIdempotencyKeyExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job: %w", err)
+	}
+	return job, nil
+}
+
+// GetJobByIdempotencyKey returns the job created with an idempotency key.
+func (r *JobRepository) GetJobByIdempotencyKey(key string) (*models.Job, error) {
+	job, err := scanJob(r.db.QueryRow("SELECT "+jobColumns+" FROM ingestion_jobs WHERE idempotency_key = $1", key))
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	return job, nil
+}
+
+func (r *JobRepository) GetJob(id string) (*models.Job, error) {
+	job, err := scanJob(r.db.QueryRow("SELECT "+jobColumns+" FROM ingestion_jobs WHERE id = $1", id))
+	if err != nil {
+		var pqErr *pq.Error
+		if err == sql.ErrNoRows || (errors.As(err, &pqErr) && pqErr.Code == "22P02") {
+			return nil, ErrJobNotFound
+		}
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	return job, nil
+}
+
+// CancelQueuedJob cancels a job that has not started yet and returns it. It
+// returns ErrJobNotFound if there is no such queued job.
+func (r *JobRepository) CancelQueuedJob(id string) (*models.Job, error) {
+	row := r.db.QueryRow(`
+		UPDATE ingestion_jobs SET state = $2, last_error = $3, finished_at = NOW()
+		WHERE id = $1 AND state = $4
+		RETURNING `+jobColumns,
+		id, models.JobCancelled, "cancelled before it started", models.JobQueued,
+	)
+	job, err := scanJob(row)
+	if err != nil {
+		var pqErr *pq.Error
+		if err == sql.ErrNoRows || (errors.As(err, &pqErr) && pqErr.Code == "22P02") {
+			return nil, ErrJobNotFound
+		}
+		return nil, fmt.Errorf("failed to cancel job: %w", err)
+	}
+	return job, nil
+}
+
+// loadLockKey is the advisory lock that serializes loads and read-side
+// publishes across instances. Loads share the staging tables and the swap of
+// promotions_temp, so they run one at a time.
+const loadLockKey = 7152013
+
+// LoadLock is the session-level advisory lock a load holds from staging to
+// publishing. It lives on a connection of its own, so it is released if the
+// process dies.
+type LoadLock struct {
+	conn *sql.Conn
+}
+
+// TryLockLoads takes the load lock, or returns nil if another instance holds
+// it.
+func (r *JobRepository) TryLockLoads() (*LoadLock, error) {
+	ctx := context.Background()
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection for load lock: %w", err)
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", loadLockKey).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to take load lock: %w", err)
+	}
+	if !locked {
+		conn.Close()
+		return nil, nil
+	}
+	return &LoadLock{conn: conn}, nil
+}
+
+// LockLoads waits for the load lock until ctx is done. The read side takes
+// it to publish, so that it does not rebuild the read DB while another
+// instance does, nor read a change log that a load is rewriting.
+func (r *JobRepository) LockLoads(ctx context.Context) (*LoadLock, error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection for load lock: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", loadLockKey); err != nil {
+		// A cancelled wait may have taken the lock all the same
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		conn.Close()
+		return nil, fmt.Errorf("failed to take load lock: %w", err)
+	}
+	return &LoadLock{conn: conn}, nil
+}
+
+// Release releases the lock. A connection that fails to release it is
+// discarded rather than returned to the pool, which releases it too.
+func (l *LoadLock) Release() error {
+	_, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", loadLockKey)
+	if err != nil {
+		l.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		l.conn.Close()
+		return fmt.Errorf("failed to release load lock: %w", err)
+	}
+	return l.conn.Close()
+}
+
+// ClaimNextJob moves the oldest queued job to the running state for an
+// owner, counting the attempt and starting its lease, and returns it, or
+// returns nil if there is nothing queued.
+func (r *JobRepository) ClaimNextJob(owner string) (*models.Job, error) {
+	row := r.db.QueryRow(`
+		UPDATE ingestion_jobs SET state = $1, attempts = attempts + 1, started_at = NOW(), owner = $3, heartbeat_at = NOW()
+		WHERE id = (
+			SELECT id FROM ingestion_jobs WHERE state = $2
+			ORDER BY created_at LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns,
+		models.JobRunning, models.JobQueued, owner,
+	)
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim job: %w", err)
+	}
+	return job, nil
+}
+
+// UpdateJobProgress records the progress of a running job and renews its
+// owner's lease. It returns ErrLeaseLost if the owner no longer runs the job.
+func (r *JobRepository) UpdateJobProgress(id, owner string, rowsRead, rowsWritten, rowsRejected int64) error {
+	result, err := r.db.Exec(`
+		UPDATE ingestion_jobs SET rows_read = $3, rows_written = $4, rows_rejected = $5, heartbeat_at = NOW()
+		WHERE id = $1 AND owner = $2 AND state = $6`,
+		id, owner, rowsRead, rowsWritten, rowsRejected, models.JobRunning,
+	)
+	return leaseResult(result, err)
+}
+
+func leaseResult(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// FinishJob records the result of a job. It returns ErrLeaseLost, and records
+// nothing, if the job's owner no longer runs it.
+func (r *JobRepository) FinishJob(job *models.Job) error {
+	violations, err := marshalViolations(job.RuleViolations)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.Exec(`
+		UPDATE ingestion_jobs
+		SET state = $2, rows_read = $3, rows_written = $4, rows_rejected = $5, duplicates = $6, rule_violations = $7,
+		    last_error = NULLIF($8, ''), reject_report = NULLIF($9, ''), sha256 = NULLIF($10, ''),
+		    dataset_id = NULLIF($11, '')::uuid, unchanged = $12, finished_at = NOW()
+		WHERE id = $1 AND owner = $13 AND state = $14`,
+		job.ID, job.State, job.RowsRead, job.RowsWritten, job.RowsRejected, job.Duplicates, violations, job.LastError, job.RejectReport,
+		job.SHA256, job.DatasetID, job.Unchanged, job.Owner, models.JobRunning,
+	)
+	return leaseResult(result, err)
+}
+
+// expiredLease selects running jobs whose owner has not renewed the lease for
+// the number of seconds in $3.
+const expiredLease = "state = $2 AND heartbeat_at < NOW() - $3 * INTERVAL '1 second'"
+
+// RequeueExpiredJobs puts running jobs whose lease has expired, because the
+// instance running them stopped, back in the queue, unless they have
+// already been attempted maxAttempts times, and returns them.
+func (r *JobRepository) RequeueExpiredJobs(lease time.Duration, maxAttempts int) ([]*models.Job, error) {
+	rows, err := r.db.Query(`
+		UPDATE ingestion_jobs SET state = $1, owner = NULL, heartbeat_at = NULL
+		WHERE `+expiredLease+` AND attempts < $4
+		RETURNING `+jobColumns,
+		models.JobQueued, models.JobRunning, lease.Seconds(), maxAttempts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+// FailExpiredJobs marks running jobs whose lease has expired as failed and
+// returns them.
+func (r *JobRepository) FailExpiredJobs(lease time.Duration, reason string) ([]*models.Job, error) {
+	rows, err := r.db.Query(`
+		UPDATE ingestion_jobs SET state = $1, last_error = $4, finished_at = NOW()
+		WHERE `+expiredLease+`
+		RETURNING `+jobColumns,
+		models.JobFailed, models.JobRunning, lease.Seconds(), reason,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+func scanJobs(rows *sql.Rows) ([]*models.Job, error) {
+	defer rows.Close()
+
+	var jobs []*models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (*models.Job, error) {
+	var job models.Job
+	var startedAt, finishedAt sql.NullTime
+	var sha, idempotencyKey, datasetID, lastError, rejectReport, owner sql.NullString
+	var violations []byte
+	err := row.Scan(&job.ID, &job.State, &job.Source, &job.Profile, &job.Format, &job.Mode, &job.Spooled, &sha, &idempotencyKey, &datasetID, &job.Unchanged,
+		&job.RowsRead, &job.RowsWritten, &job.RowsRejected, &job.Duplicates, &violations, &job.Attempts, &job.CreatedAt, &startedAt, &finishedAt,
+		&lastError, &rejectReport, &owner)
+	if err != nil {
+		return nil, err
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	job.SHA256 = sha.String
+	job.IdempotencyKey = idempotencyKey.String
+	job.DatasetID = datasetID.String
+	job.LastError = lastError.String
+	job.RejectReport = rejectReport.String
+	job.Owner = owner.String
+	if job.RuleViolations, err = unmarshalViolations(violations); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// marshalViolations encodes rule violations for a JSONB column, which is
+// NULL if there are none.
+func marshalViolations(violations []models.RuleViolation) (sql.NullString, error) {
+	if len(violations) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(violations)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode rule violations: %w", err)
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+func unmarshalViolations(b []byte) ([]models.RuleViolation, error) {
+	if b == nil {
+		return nil, nil
+	}
+	var violations []models.RuleViolation
+	if err := json.Unmarshal(b, &violations); err != nil {
+		return nil, fmt.Errorf("failed to decode rule violations: %w", err)
+	}
+	return violations, nil
+}
@@ -4,55 +4,110 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
 	"github.com/sh3ll3y/promotion-service/internal/logging"
 	"github.com/sh3ll3y/promotion-service/internal/metrics"
 	"github.com/sh3ll3y/promotion-service/internal/models"
 	"go.uber.org/zap"
 	"strings"
+	"sync"
 	"time"
 )
 
+// promotionColumns are the columns of a promotion, in the order of
+// promotionValues and scanPromotion.
+const promotionColumns = "id, price, currency, starts_at, expiration_date, metadata"
+
+func promotionValues(p *models.Promotion) []interface{} {
+	return []interface{}{p.ID, p.Price, p.Currency, p.StartsAt, p.ExpirationDate, p.Metadata}
+}
+
+func scanPromotion(row interface{ Scan(...interface{}) error }) (*models.Promotion, error) {
+	p := &models.Promotion{}
+	if err := row.Scan(&p.ID, &p.Price, &p.Currency, &p.StartsAt, &p.ExpirationDate, &p.Metadata); err != nil {
+		return nil, err
+	}
+	// Postgres returns TIMESTAMPTZ values in the session time zone
+	p.StartsAt = utc(p.StartsAt)
+	p.ExpirationDate = p.ExpirationDate.UTC()
+	return p, nil
+}
+
+// valuesList returns the VALUES list of an INSERT of promotions and its
+// arguments.
+func valuesList(promotions []*models.Promotion) (string, []interface{}) {
+	width := strings.Count(promotionColumns, ",") + 1
+	valueStrings := make([]string, 0, len(promotions))
+	valueArgs := make([]interface{}, 0, len(promotions)*width)
+	placeholders := make([]string, width)
+	for _, p := range promotions {
+		for i := range placeholders {
+			placeholders[i] = fmt.Sprintf("$%d", len(valueArgs)+i+1)
+		}
+		valueStrings = append(valueStrings, "("+strings.Join(placeholders, ", ")+")")
+		valueArgs = append(valueArgs, promotionValues(p)...)
+	}
+	return strings.Join(valueStrings, ","), valueArgs
+}
+
+// ErrInvalidCursor is returned for a page cursor that is not a promotion ID.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// PromotionFilter selects the promotions ListPromotions returns.
+type PromotionFilter struct {
+	// Metadata holds attributes the promotions must have, with these values
+	Metadata models.Metadata
+	// IncludeInactive also selects scheduled and expired promotions
+	IncludeInactive bool
+	// After is the ID of the last promotion of the previous page
+	After string
+	Limit int
+}
+
+// datasetVersionTTL is how long the version of the published dataset and the
+// cache generation are cached in memory.
+const datasetVersionTTL = 5 * time.Second
+
 type ReadRepository struct {
 	db    *sql.DB
 	cache *redis.Client
+
+	versionMu  sync.Mutex
+	version    string
+	generation string
+	versionAt  time.Time
 }
 
 func NewReadRepository(db *sql.DB, cache *redis.Client) *ReadRepository {
 	return &ReadRepository{db: db, cache: cache}
 }
 
-func (r *ReadRepository) ClearTempTable() error {
-	_, err := r.db.Exec("DELETE FROM promotions_temp")
+func (r *ReadRepository) ClearTempTable(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM promotions_temp")
 	return err
 }
 
-func (r *ReadRepository) BulkInsertPromotions(promotions []*models.Promotion) error {
+func (r *ReadRepository) BulkInsertPromotions(ctx context.Context, promotions []*models.Promotion) error {
 	if len(promotions) == 0 {
 		return nil
 	}
 
 	// Start a transaction
-	tx, err := r.db.Begin()
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
 	// Prepare the bulk insert query
-	valueStrings := make([]string, 0, len(promotions))
-	valueArgs := make([]interface{}, 0, len(promotions)*3)
-	for i, p := range promotions {
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d)", i*3+1, i*3+2, i*3+3))
-		valueArgs = append(valueArgs, p.ID, p.Price, p.ExpirationDate)
-	}
-
-	stmt := fmt.Sprintf("INSERT INTO promotions_temp (id, price, expiration_date) VALUES %s",
-		strings.Join(valueStrings, ","))
+	values, valueArgs := valuesList(promotions)
+	stmt := fmt.Sprintf("INSERT INTO promotions_temp (%s) VALUES %s", promotionColumns, values)
 
 	// Execute the bulk insert
-	_, err = tx.Exec(stmt, valueArgs...)
+	_, err = tx.ExecContext(ctx, stmt, valueArgs...)
 	if err != nil {
 		return fmt.Errorf("failed to insert promotions: %w", err)
 	}
@@ -65,23 +120,175 @@ func (r *ReadRepository) BulkInsertPromotions(promotions []*models.Promotion) er
 	return nil
 }
 
-func (r *ReadRepository) SwapTables() error {
-	_, err := r.db.Exec(`
+// ApplyChanges upserts and deletes promotions in place and evicts them from
+// the cache.
+func (r *ReadRepository) ApplyChanges(ctx context.Context, upserts []*models.Promotion, deletes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if len(upserts) > 0 {
+		values, valueArgs := valuesList(upserts)
+		stmt := fmt.Sprintf(`INSERT INTO promotions (%s) VALUES %s
+			ON CONFLICT (id) DO UPDATE SET price = EXCLUDED.price, currency = EXCLUDED.currency,
+				starts_at = EXCLUDED.starts_at, expiration_date = EXCLUDED.expiration_date, metadata = EXCLUDED.metadata`,
+			promotionColumns, values)
+		if _, err := tx.ExecContext(ctx, stmt, valueArgs...); err != nil {
+			return fmt.Errorf("failed to upsert promotions: %w", err)
+		}
+	}
+
+	if len(deletes) > 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM promotions WHERE id = ANY($1)", pq.Array(deletes)); err != nil {
+			return fmt.Errorf("failed to delete promotions: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Evict after the commit, so the cache cannot be refilled with the old rows.
+	// The changes are committed, so they are evicted even if ctx is cancelled.
+	// The generation is read afresh, as the table may just have been swapped.
+	if r.cache != nil && len(upserts)+len(deletes) > 0 {
+		_, generation, err := r.loadPublished(context.Background())
+		if err != nil {
+			logging.Logger.Error("Error evicting changed promotions from cache", zap.Error(err))
+			return nil
+		}
+		keys := make([]string, 0, len(upserts)+len(deletes))
+		for _, p := range upserts {
+			keys = append(keys, promotionKey(generation, p.ID))
+		}
+		for _, id := range deletes {
+			keys = append(keys, promotionKey(generation, id))
+		}
+		if err := r.cache.Del(context.Background(), keys...).Err(); err != nil {
+			logging.Logger.Error("Error evicting changed promotions from cache", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// SwapTables swaps the rebuilt table in and records the dataset it holds, in
+// one transaction. The swap starts a new cache generation, so promotions
+// cached from the old table are not served again; they expire with their TTL.
+func (r *ReadRepository) SwapTables(ctx context.Context, datasetID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
         ALTER TABLE promotions RENAME TO promotions_old;
         ALTER TABLE promotions_temp RENAME TO promotions;
         ALTER TABLE promotions_old RENAME TO promotions_temp;
         TRUNCATE TABLE promotions_temp;
     `)
-	return err
+	if err != nil {
+		return err
+	}
+
+	var generation string
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO published_dataset (dataset_id) VALUES ($1)
+		ON CONFLICT (singleton) DO UPDATE SET dataset_id = EXCLUDED.dataset_id, published_at = NOW(),
+			cache_generation = EXCLUDED.cache_generation
+		RETURNING cache_generation`,
+		datasetID,
+	).Scan(&generation)
+	if err != nil {
+		return fmt.Errorf("failed to record dataset version: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.versionMu.Lock()
+	r.version, r.generation, r.versionAt = datasetID, generation, time.Now()
+	r.versionMu.Unlock()
+	return nil
+}
+
+// SetDatasetVersion records the ID of the dataset the read DB holds after
+// changes were applied in place. The cache generation is kept.
+func (r *ReadRepository) SetDatasetVersion(ctx context.Context, id string) error {
+	var generation string
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO published_dataset (dataset_id) VALUES ($1)
+		ON CONFLICT (singleton) DO UPDATE SET dataset_id = EXCLUDED.dataset_id, published_at = NOW()
+		RETURNING cache_generation`,
+		id,
+	).Scan(&generation)
+	if err != nil {
+		return fmt.Errorf("failed to record dataset version: %w", err)
+	}
+
+	r.versionMu.Lock()
+	r.version, r.generation, r.versionAt = id, generation, time.Now()
+	r.versionMu.Unlock()
+	return nil
+}
+
+// DatasetVersion returns the ID of the dataset the read DB holds, or an empty
+// string if none has been recorded. It is cached for datasetVersionTTL, so
+// that the version set by another instance shows up shortly after.
+func (r *ReadRepository) DatasetVersion(ctx context.Context) (string, error) {
+	version, _, err := r.published(ctx)
+	return version, err
 }
 
+// published returns the dataset version and the cache generation, cached for
+// datasetVersionTTL.
+func (r *ReadRepository) published(ctx context.Context) (string, string, error) {
+	r.versionMu.Lock()
+	if !r.versionAt.IsZero() && time.Since(r.versionAt) < datasetVersionTTL {
+		defer r.versionMu.Unlock()
+		return r.version, r.generation, nil
+	}
+	r.versionMu.Unlock()
+	return r.loadPublished(ctx)
+}
 
-func (r *ReadRepository) GetPromotion(id string) (*models.Promotion, error) {
-	ctx := context.Background()
+// loadPublished reads the dataset version and the cache generation from the
+// read DB. Both are empty before the first publish.
+func (r *ReadRepository) loadPublished(ctx context.Context) (string, string, error) {
+	var version, generation string
+	err := r.db.QueryRowContext(ctx, "SELECT dataset_id, cache_generation FROM published_dataset").Scan(&version, &generation)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", fmt.Errorf("failed to get dataset version: %w", err)
+	}
 
-	// Try to get from cache first
+	r.versionMu.Lock()
+	r.version, r.generation, r.versionAt = version, generation, time.Now()
+	r.versionMu.Unlock()
+	return version, generation, nil
+}
+
+// promotionKey is the cache key of a promotion in a cache generation.
+func promotionKey(generation, id string) string {
+	return "promotion:" + generation + ":" + id
+}
+
+func (r *ReadRepository) GetPromotion(ctx context.Context, id string) (*models.Promotion, error) {
+	// Try to get from cache first, under the generation of the table. Without
+	// it the cache is bypassed.
+	var key string
 	if r.cache != nil {
-		cachedPromotion, err := r.cache.Get(ctx, id).Result()
+		if _, generation, err := r.published(ctx); err != nil {
+			logging.Logger.Error("Error getting cache generation", zap.Error(err))
+		} else {
+			key = promotionKey(generation, id)
+		}
+	}
+	if key != "" {
+		cachedPromotion, err := r.cache.Get(ctx, key).Result()
 		if err == nil {
 			metrics.CacheHits.Inc()
 			var promotion models.Promotion
@@ -98,9 +305,7 @@ func (r *ReadRepository) GetPromotion(id string) (*models.Promotion, error) {
 	metrics.CacheMisses.Inc()
 
 	// If not in cache or cache failed, get from database
-	var promotion models.Promotion
-	err := r.db.QueryRow("SELECT id, price, expiration_date FROM promotions WHERE id = $1", id).
-		Scan(&promotion.ID, &promotion.Price, &promotion.ExpirationDate)
+	promotion, err := scanPromotion(r.db.QueryRowContext(ctx, "SELECT "+promotionColumns+" FROM promotions WHERE id = $1", id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("promotion not found")
@@ -111,15 +316,63 @@ func (r *ReadRepository) GetPromotion(id string) (*models.Promotion, error) {
 	metrics.DatabaseOperations.WithLabelValues("read").Inc()
 
 	// Store in cache for future requests
-	if r.cache != nil {
+	if key != "" {
 		promotionJSON, _ := json.Marshal(promotion)
-		err = r.cache.Set(ctx, id, promotionJSON, time.Hour).Err()
+		err = r.cache.Set(ctx, key, promotionJSON, time.Hour).Err()
 		if err != nil {
 			logging.Logger.Error("Error setting promotion in cache", zap.Error(err))
 		}
 	}
 
-	return &promotion, nil
+	return promotion, nil
 }
 
+// ListPromotions returns a page of the promotions that match a filter, in ID
+// order. Metadata filters are containment queries, which the GIN index on
+// metadata serves. Lists are not cached.
+func (r *ReadRepository) ListPromotions(ctx context.Context, filter PromotionFilter) ([]*models.Promotion, error) {
+	var conditions []string
+	var args []interface{}
+	if len(filter.Metadata) > 0 {
+		args = append(args, filter.Metadata)
+		conditions = append(conditions, fmt.Sprintf("metadata @> $%d::jsonb", len(args)))
+	}
+	if filter.After != "" {
+		args = append(args, filter.After)
+		conditions = append(conditions, fmt.Sprintf("id > $%d", len(args)))
+	}
+	if !filter.IncludeInactive {
+		conditions = append(conditions, "(starts_at IS NULL OR starts_at <= NOW()) AND expiration_date > NOW()")
+	}
+	query := "SELECT " + promotionColumns + " FROM promotions"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY id LIMIT $%d", len(args))
 
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "22P02" {
+			return nil, fmt.Errorf("%w %q", ErrInvalidCursor, filter.After)
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	promotions := []*models.Promotion{}
+	for rows.Next() {
+		p, err := scanPromotion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		promotions = append(promotions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	metrics.DatabaseOperations.WithLabelValues("list").Inc()
+	return promotions, nil
+}
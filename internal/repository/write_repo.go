@@ -1,11 +1,33 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/lib/pq"
+	"github.com/sh3ll3y/promotion-service/internal/metrics"
 	"github.com/sh3ll3y/promotion-service/internal/models"
+	"github.com/sh3ll3y/promotion-service/internal/money"
+	"strings"
+	"time"
 )
 
+var ErrDuplicateIDs = errors.New("file repeats promotion IDs")
+
+// ErrMixedCurrencies is returned when the lowest_price policy would have to
+// compare the prices of an ID in different currencies.
+var ErrMixedCurrencies = errors.New("file repeats promotion IDs with prices in different currencies")
+
+// duplicateOrder sorts the rows of an ID so that the one a policy keeps comes
+// first.
+var duplicateOrder = map[models.DuplicatePolicy]string{
+	models.DuplicateReject:      "line",
+	models.DuplicateFirst:       "line",
+	models.DuplicateLast:        "line DESC",
+	models.DuplicateLowestPrice: "price, line",
+}
+
 type WriteRepository struct {
 	db *sql.DB
 }
@@ -14,30 +36,682 @@ func NewWriteRepository(db *sql.DB) *WriteRepository {
 	return &WriteRepository{db: db}
 }
 
-func (r *WriteRepository) ClearAllPromotions() error {
-	_, err := r.db.Exec("DELETE FROM promotions")
+// ClearStagingTable drops what a job has staged in promotions_staging, which
+// holds a load until it is published, along with the job's checkpoint. The
+// loads of other jobs are left alone.
+func (r *WriteRepository) ClearStagingTable(ctx context.Context, jobID string) error {
+	return r.clearStaged(ctx, "promotions_staging", jobID)
+}
+
+func (r *WriteRepository) clearStaged(ctx context.Context, table, jobID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteStaged(ctx, tx, table, jobID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteStaged deletes the rows a job has staged in a table and its
+// checkpoint.
+func deleteStaged(ctx context.Context, tx *sql.Tx, table, jobID string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE job_id = $1", jobID); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", table, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ingestion_checkpoints WHERE job_id = $1", jobID); err != nil {
+		return fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	return nil
+}
+
+// stagedLine is the line a staged row is ordered by. Lines of a split load
+// are counted from the start of their range, so rows are ordered by range
+// first.
+func stagedLine(line int, checkpoint *models.Checkpoint) int64 {
+	if checkpoint.Range == nil {
+		return int64(line)
+	}
+	return int64(checkpoint.Range.Index)<<32 | int64(line)
+}
+
+// StagePromotions streams a batch into the staging table with COPY FROM
+// STDIN. The batch and the checkpoint reached after it are committed as a
+// single transaction.
+func (r *WriteRepository) StagePromotions(ctx context.Context, promotions []*models.PromotionRecord, checkpoint *models.Checkpoint) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if len(promotions) == 0 {
+		return r.commitCheckpoint(ctx, tx, checkpoint)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("promotions_staging", "job_id", "line", "id", "price", "currency", "starts_at", "expiration_date", "metadata"))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy: %w", err)
+	}
+
+	for _, p := range promotions {
+		if _, err := stmt.ExecContext(ctx, checkpoint.JobID, stagedLine(p.Line, checkpoint), p.ID, p.Price, p.Currency, p.StartsAt, p.ExpirationDate, p.Metadata); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy promotion %s: %w", p.ID, err)
+		}
+	}
+
+	// Flush the buffered rows and finish the COPY
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to copy promotions: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to close copy: %w", err)
+	}
+
+	if err := r.commitCheckpoint(ctx, tx, checkpoint); err != nil {
+		return err
+	}
+
+	metrics.DatabaseOperations.WithLabelValues("copy").Inc()
+	return nil
+}
+
+// PublishStagedPromotions deduplicates the load staged by the dataset's job
+// into promotions_temp and swaps that with the promotions table in a single
+// transaction, so readers see either the previous dataset or the new one but
+// never a partial load.
+//
+// Rows repeating an ID are resolved by the policy; it returns how many rows
+// were dropped. Under DuplicateReject any repeat fails with ErrDuplicateIDs,
+// and under DuplicateLowestPrice an ID repeated in several currencies fails
+// with ErrMixedCurrencies.
+// The load is recorded as the given dataset, whose ID and row counts are set.
+func (r *WriteRepository) PublishStagedPromotions(ctx context.Context, policy models.DuplicatePolicy, dataset *models.Dataset) (int64, error) {
+	order, ok := duplicateOrder[policy]
+	if !ok {
+		return 0, fmt.Errorf("unknown duplicate policy %q", policy)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var duplicates int64
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) - COUNT(DISTINCT id) FROM promotions_staging WHERE job_id = $1", dataset.JobID).Scan(&duplicates)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count duplicate IDs: %w", err)
+	}
+	if duplicates > 0 && policy == models.DuplicateReject {
+		return duplicates, duplicateIDsError(ctx, tx, "promotions_staging", dataset.JobID, duplicates)
+	}
+	if duplicates > 0 && policy == models.DuplicateLowestPrice {
+		if err := checkDuplicateCurrencies(ctx, tx, dataset.JobID); err != nil {
+			return duplicates, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "TRUNCATE TABLE promotions_temp"); err != nil {
+		return 0, fmt.Errorf("failed to clear promotions_temp: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO promotions_temp (id, price, currency, starts_at, expiration_date, metadata)
+		SELECT DISTINCT ON (id) id, price, currency, starts_at, expiration_date, metadata
+		FROM promotions_staging WHERE job_id = $1
+		ORDER BY id, `+order, dataset.JobID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to deduplicate staged promotions: %w", err)
+	}
+	if dataset.Rows, err = result.RowsAffected(); err != nil {
+		return 0, fmt.Errorf("failed to count staged promotions: %w", err)
+	}
+	dataset.TotalRows = dataset.Rows
+
+	_, err = tx.ExecContext(ctx, `
+        ALTER TABLE promotions RENAME TO promotions_old;
+        ALTER TABLE promotions_temp RENAME TO promotions;
+        ALTER TABLE promotions_old RENAME TO promotions_temp;
+        TRUNCATE TABLE promotions_temp;
+    `)
+	if err != nil {
+		return 0, fmt.Errorf("failed to swap tables: %w", err)
+	}
+	if err := deleteStaged(ctx, tx, "promotions_staging", dataset.JobID); err != nil {
+		return 0, err
+	}
+
+	if err := recordDataset(ctx, tx, dataset); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	metrics.DatabaseOperations.WithLabelValues("swap").Inc()
+	return duplicates, nil
+}
+
+// duplicateIDsError names a few of the IDs a job repeated in a staging table.
+func duplicateIDsError(ctx context.Context, tx *sql.Tx, table, jobID string, duplicates int64) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM "+table+" WHERE job_id = $1 GROUP BY id HAVING COUNT(*) > 1 ORDER BY id LIMIT 5", jobID)
+	if err != nil {
+		return fmt.Errorf("failed to list duplicate IDs: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to list duplicate IDs: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list duplicate IDs: %w", err)
+	}
+	return fmt.Errorf("%w: %d duplicate rows, including %s", ErrDuplicateIDs, duplicates, strings.Join(ids, ", "))
+}
+
+// checkDuplicateCurrencies fails with ErrMixedCurrencies, naming a few of
+// the IDs, if a job staged an ID with prices in different currencies.
+func checkDuplicateCurrencies(ctx context.Context, tx *sql.Tx, jobID string) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM promotions_staging WHERE job_id = $1
+		GROUP BY id HAVING COUNT(DISTINCT currency) > 1 ORDER BY id LIMIT 5`, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to check duplicate currencies: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to check duplicate currencies: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check duplicate currencies: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w, including %s", ErrMixedCurrencies, strings.Join(ids, ", "))
+}
+
+// ClearStagedChanges drops the changes a job has staged and its checkpoint.
+func (r *WriteRepository) ClearStagedChanges(ctx context.Context, jobID string) error {
+	return r.clearStaged(ctx, "promotion_changes_staging", jobID)
+}
+
+// StageChanges streams a batch of delta records into the change staging
+// table with COPY FROM STDIN, committing the checkpoint along with it.
+func (r *WriteRepository) StageChanges(ctx context.Context, changes []*models.PromotionRecord, checkpoint *models.Checkpoint) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if len(changes) == 0 {
+		return r.commitCheckpoint(ctx, tx, checkpoint)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("promotion_changes_staging", "job_id", "line", "operation", "id", "price", "currency", "starts_at", "expiration_date", "metadata"))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy: %w", err)
+	}
+
+	for _, c := range changes {
+		var price, currency, startsAt, expirationDate, metadata interface{}
+		if c.Operation != models.OperationDelete {
+			price, currency, startsAt, expirationDate, metadata = c.Price, c.Currency, c.StartsAt, c.ExpirationDate, c.Metadata
+		}
+		if _, err := stmt.ExecContext(ctx, checkpoint.JobID, stagedLine(c.Line, checkpoint), c.Operation, c.ID, price, currency, startsAt, expirationDate, metadata); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy change for promotion %s: %w", c.ID, err)
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to copy changes: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to close copy: %w", err)
+	}
+
+	if err := r.commitCheckpoint(ctx, tx, checkpoint); err != nil {
+		return err
+	}
+
+	metrics.DatabaseOperations.WithLabelValues("copy").Inc()
+	return nil
+}
+
+// commitCheckpoint records how far a load has got and commits the
+// transaction that staged the rows before it.
+func (r *WriteRepository) commitCheckpoint(ctx context.Context, tx *sql.Tx, cp *models.Checkpoint) error {
+	violations, err := marshalViolations(cp.RuleViolations)
+	if err != nil {
+		return err
+	}
+	if cp.Range != nil {
+		err = saveRangeCheckpoint(ctx, tx, cp, violations)
+	} else {
+		err = saveCheckpoint(ctx, tx, cp, violations)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func saveCheckpoint(ctx context.Context, tx *sql.Tx, cp *models.Checkpoint, violations sql.NullString) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO ingestion_checkpoints (job_id, fingerprint, byte_offset, line, header, rows_read, rows_written, rows_rejected, reject_report_size, rule_violations, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW())
+		ON CONFLICT (job_id) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint, byte_offset = EXCLUDED.byte_offset, line = EXCLUDED.line,
+			header = EXCLUDED.header, rows_read = EXCLUDED.rows_read, rows_written = EXCLUDED.rows_written,
+			rows_rejected = EXCLUDED.rows_rejected, reject_report_size = EXCLUDED.reject_report_size,
+			rule_violations = EXCLUDED.rule_violations, updated_at = EXCLUDED.updated_at`,
+		cp.JobID, cp.Fingerprint, cp.Offset, cp.Line, pq.Array(cp.Header),
+		cp.RowsRead, cp.RowsWritten, cp.RowsRejected, cp.RejectReportSize, violations,
+	)
 	return err
 }
 
-func (r *WriteRepository) CreatePromotion(p *models.Promotion) error {
-	_, err := r.db.Exec(
-		"INSERT INTO promotions (id, price, expiration_date) VALUES ($1, $2, $3)",
-		p.ID, p.Price, p.ExpirationDate,
+// saveRangeCheckpoint records the progress of a byte range of a split load.
+// The ranges share a checkpoint for the file, which the first range to commit
+// creates; the counts of the load are kept per range, so that the ranges can
+// commit concurrently.
+func saveRangeCheckpoint(ctx context.Context, tx *sql.Tx, cp *models.Checkpoint, violations sql.NullString) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO ingestion_checkpoints (job_id, fingerprint, byte_offset, line, header, rows_read, rows_written, rows_rejected, reject_report_size, updated_at)
+		VALUES ($1, $2, 0, 0, $3, 0, 0, 0, 0, NOW())
+		ON CONFLICT (job_id) DO NOTHING`,
+		cp.JobID, cp.Fingerprint, pq.Array(cp.Header),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to insert promotion: %w", err)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO ingestion_range_checkpoints (job_id, range_index, range_start, range_end, byte_offset, line, rows_read, rows_written, rows_rejected, reject_report_size, rule_violations, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW())
+		ON CONFLICT (job_id, range_index) DO UPDATE SET
+			byte_offset = EXCLUDED.byte_offset, line = EXCLUDED.line, rows_read = EXCLUDED.rows_read,
+			rows_written = EXCLUDED.rows_written, rows_rejected = EXCLUDED.rows_rejected,
+			reject_report_size = EXCLUDED.reject_report_size, rule_violations = EXCLUDED.rule_violations,
+			updated_at = EXCLUDED.updated_at`,
+		cp.JobID, cp.Range.Index, cp.Range.Start, cp.Range.End, cp.Offset, cp.Line,
+		cp.RowsRead, cp.RowsWritten, cp.RowsRejected, cp.RejectReportSize, violations,
+	)
+	return err
+}
+
+// GetCheckpoint returns the last checkpoint of a job, or nil if the job has
+// none.
+func (r *WriteRepository) GetCheckpoint(ctx context.Context, jobID string) (*models.Checkpoint, error) {
+	cp := &models.Checkpoint{}
+	var violations []byte
+	err := r.db.QueryRowContext(ctx, `
+		SELECT job_id, fingerprint, byte_offset, line, header, rows_read, rows_written, rows_rejected, reject_report_size, rule_violations, updated_at
+		FROM ingestion_checkpoints WHERE job_id = $1`, jobID,
+	).Scan(&cp.JobID, &cp.Fingerprint, &cp.Offset, &cp.Line, pq.Array(&cp.Header),
+		&cp.RowsRead, &cp.RowsWritten, &cp.RowsRejected, &cp.RejectReportSize, &violations, &cp.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	if cp.RuleViolations, err = unmarshalViolations(violations); err != nil {
+		return nil, err
+	}
+	if err := r.getRangeCheckpoints(ctx, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// getRangeCheckpoints adds the ranges of a split load to its checkpoint.
+func (r *WriteRepository) getRangeCheckpoints(ctx context.Context, cp *models.Checkpoint) error {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT range_index, range_start, range_end, byte_offset, line, rows_read, rows_written, rows_rejected, reject_report_size, rule_violations, updated_at
+		FROM ingestion_range_checkpoints WHERE job_id = $1 ORDER BY range_index`, cp.JobID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get range checkpoints: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rc := models.Checkpoint{JobID: cp.JobID, Fingerprint: cp.Fingerprint, Header: cp.Header, Range: &models.ByteRange{}}
+		var violations []byte
+		err := rows.Scan(&rc.Range.Index, &rc.Range.Start, &rc.Range.End, &rc.Offset, &rc.Line,
+			&rc.RowsRead, &rc.RowsWritten, &rc.RowsRejected, &rc.RejectReportSize, &violations, &rc.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to scan range checkpoint: %w", err)
+		}
+		if rc.RuleViolations, err = unmarshalViolations(violations); err != nil {
+			return err
+		}
+		cp.RowsRead += rc.RowsRead
+		cp.RowsWritten += rc.RowsWritten
+		cp.RowsRejected += rc.RowsRejected
+		cp.Ranges = append(cp.Ranges, rc)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get range checkpoints: %w", err)
+	}
+	return nil
+}
+
+// ApplyStagedChanges applies the delta load staged by the dataset's job to the
+// promotions table in a single transaction and logs the changed IDs under a
+// new change set, which it returns along with the number of superseded
+// changes. When an ID occurs
+// more than once, its last line wins. The load is recorded as the given
+// dataset, whose ID, base and row counts are set.
+func (r *WriteRepository) ApplyStagedChanges(ctx context.Context, dataset *models.Dataset) (string, int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var changeSet string
+	if err := tx.QueryRowContext(ctx, "SELECT gen_random_uuid()").Scan(&changeSet); err != nil {
+		return "", 0, fmt.Errorf("failed to create change set: %w", err)
+	}
+
+	var duplicates int64
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) - COUNT(DISTINCT id) FROM promotion_changes_staging WHERE job_id = $1", dataset.JobID).Scan(&duplicates)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to count duplicate IDs: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		CREATE TEMPORARY TABLE latest_changes ON COMMIT DROP AS
+		SELECT DISTINCT ON (id) id, operation, price, currency, starts_at, expiration_date, metadata
+		FROM promotion_changes_staging WHERE job_id = $1
+		ORDER BY id, line DESC`, dataset.JobID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to collect changes: %w", err)
+	}
+
+	// A row without xmax was inserted rather than updated
+	var inserted int64
+	err = tx.QueryRowContext(ctx, `
+		WITH upserted AS (
+			INSERT INTO promotions (id, price, currency, starts_at, expiration_date, metadata)
+			SELECT id, price, currency, starts_at, expiration_date, metadata FROM latest_changes WHERE operation = $1
+			ON CONFLICT (id) DO UPDATE SET price = EXCLUDED.price, currency = EXCLUDED.currency,
+				starts_at = EXCLUDED.starts_at, expiration_date = EXCLUDED.expiration_date, metadata = EXCLUDED.metadata
+			RETURNING xmax = 0 AS inserted
+		)
+		SELECT COUNT(*) FILTER (WHERE inserted) FROM upserted`,
+		models.OperationUpsert,
+	).Scan(&inserted)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to upsert promotions: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM promotions p USING latest_changes c
+		WHERE p.id = c.id AND c.operation = $1`,
+		models.OperationDelete,
+	)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to delete promotions: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to count deleted promotions: %w", err)
+	}
+	if err := applyDelta(ctx, tx, dataset, inserted-deleted); err != nil {
+		return "", 0, err
+	}
+
+	result, err = tx.ExecContext(ctx, "INSERT INTO promotion_changes (change_set, id) SELECT $1, id FROM latest_changes", changeSet)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to log changes: %w", err)
+	}
+	if dataset.Rows, err = result.RowsAffected(); err != nil {
+		return "", 0, fmt.Errorf("failed to count changes: %w", err)
+	}
+
+	if err := deleteStaged(ctx, tx, "promotion_changes_staging", dataset.JobID); err != nil {
+		return "", 0, err
+	}
+
+	dataset.ChangeSet = changeSet
+	if err := recordDataset(ctx, tx, dataset); err != nil {
+		return "", 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	metrics.DatabaseOperations.WithLabelValues("apply_changes").Inc()
+	return changeSet, duplicates, nil
+}
+
+// applyDelta sets the base and the total row count of a delta dataset, which
+// added rows to the promotions of the dataset loaded before it.
+func applyDelta(ctx context.Context, tx *sql.Tx, dataset *models.Dataset, added int64) error {
+	var base sql.NullString
+	var total int64
+	err := tx.QueryRowContext(ctx, "SELECT COALESCE(base_id, id), total_rows FROM datasets ORDER BY loaded_at DESC LIMIT 1").Scan(&base, &total)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to get base dataset: %w", err)
+	}
+	dataset.BaseID = base.String
+	dataset.TotalRows = total + added
 	return nil
 }
 
-func (r *WriteRepository) GetTotalPromotionsCount() (int, error) {
+func recordDataset(ctx context.Context, tx *sql.Tx, dataset *models.Dataset) error {
+	dataset.Status = models.DatasetLoaded
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO datasets (job_id, source, sha256, profile, format, mode, rows, total_rows, base_id, change_set, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, '')::uuid, NULLIF($10, '')::uuid, $11)
+		RETURNING id, loaded_at`,
+		dataset.JobID, dataset.Source, dataset.SHA256, dataset.Profile, dataset.Format, dataset.Mode, dataset.Rows, dataset.TotalRows,
+		dataset.BaseID, dataset.ChangeSet, dataset.Status,
+	).Scan(&dataset.ID, &dataset.LoadedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record dataset: %w", err)
+	}
+	return nil
+}
+
+const datasetColumns = "id, job_id, source, sha256, profile, format, mode, rows, total_rows, base_id, change_set, status, loaded_at, published_at"
+
+func scanDataset(row interface{ Scan(...interface{}) error }) (*models.Dataset, error) {
+	dataset := &models.Dataset{}
+	var baseID, changeSet sql.NullString
+	err := row.Scan(&dataset.ID, &dataset.JobID, &dataset.Source, &dataset.SHA256, &dataset.Profile, &dataset.Format, &dataset.Mode,
+		&dataset.Rows, &dataset.TotalRows, &baseID, &changeSet, &dataset.Status, &dataset.LoadedAt, &dataset.PublishedAt)
+	if err != nil {
+		return nil, err
+	}
+	dataset.BaseID = baseID.String
+	dataset.ChangeSet = changeSet.String
+	dataset.LoadedAt = dataset.LoadedAt.UTC()
+	dataset.PublishedAt = utc(dataset.PublishedAt)
+	return dataset, nil
+}
+
+// PublishedDataset returns the dataset that was published last, or nil if
+// nothing has been published.
+func (r *WriteRepository) PublishedDataset(ctx context.Context) (*models.Dataset, error) {
+	dataset, err := scanDataset(r.db.QueryRowContext(ctx, "SELECT "+datasetColumns+" FROM datasets WHERE status = $1 ORDER BY published_at DESC LIMIT 1",
+		models.DatasetPublished))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get published dataset: %w", err)
+	}
+	return dataset, nil
+}
+
+// ListDatasets returns the latest datasets, newest first. An empty status
+// lists datasets of every status.
+func (r *WriteRepository) ListDatasets(ctx context.Context, status models.DatasetStatus, limit int) ([]*models.Dataset, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+datasetColumns+` FROM datasets
+		WHERE $1 = '' OR status = $1
+		ORDER BY loaded_at DESC LIMIT $2`,
+		status, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list datasets: %w", err)
+	}
+	defer rows.Close()
+
+	datasets := []*models.Dataset{}
+	for rows.Next() {
+		dataset, err := scanDataset(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dataset: %w", err)
+		}
+		datasets = append(datasets, dataset)
+	}
+	return datasets, rows.Err()
+}
+
+// GetDatasetStatus returns the status of a dataset.
+func (r *WriteRepository) GetDatasetStatus(ctx context.Context, id string) (models.DatasetStatus, error) {
+	var status models.DatasetStatus
+	if err := r.db.QueryRowContext(ctx, "SELECT status FROM datasets WHERE id = $1", id).Scan(&status); err != nil {
+		return "", fmt.Errorf("failed to get dataset status: %w", err)
+	}
+	return status, nil
+}
+
+// MarkDatasetPublished records that the read side has published a dataset.
+// A full dataset supersedes the datasets published before it. The change log
+// is only needed until the read side has applied it, so the change set of a
+// delta dataset is dropped once it is published, and those of all deltas
+// loaded before a full dataset once that is. Marking a dataset that is not
+// loaded, e.g. because another instance marked it already, does nothing.
+func (r *WriteRepository) MarkDatasetPublished(ctx context.Context, id string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Only delta datasets have a change set
+	var full bool
+	var loadedAt time.Time
+	err = tx.QueryRowContext(ctx, `
+		UPDATE datasets SET status = $2, published_at = NOW()
+		WHERE id = $1 AND status = $3
+		RETURNING change_set IS NULL, loaded_at`,
+		id, models.DatasetPublished, models.DatasetLoaded,
+	).Scan(&full, &loadedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark dataset published: %w", err)
+	}
+
+	if full {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE datasets SET status = $2
+			WHERE id <> $1 AND status = $3 AND loaded_at <= $4`,
+			id, models.DatasetSuperseded, models.DatasetPublished, loadedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to supersede datasets: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM promotion_changes WHERE change_set IN (
+			SELECT change_set FROM datasets
+			WHERE change_set IS NOT NULL AND (id = $1 OR ($2 AND loaded_at <= $3))
+		)`,
+		id, full, loadedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to drop applied changes: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetChangedPromotionsBatch returns the promotions changed in a change set
+// with their current state. IDs that no longer exist are returned as deletes.
+func (r *WriteRepository) GetChangedPromotionsBatch(ctx context.Context, changeSet string, offset, limit int) ([]*models.PromotionRecord, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT c.id, p.price, p.currency, p.starts_at, p.expiration_date, p.metadata
+		FROM promotion_changes c LEFT JOIN promotions p ON p.id = c.id
+		WHERE c.change_set = $1
+		ORDER BY c.id LIMIT $2 OFFSET $3`,
+		changeSet, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*models.PromotionRecord
+	for rows.Next() {
+		c := &models.PromotionRecord{Operation: models.OperationUpsert}
+		var price, currency sql.NullString
+		var startsAt, expirationDate sql.NullTime
+		if err := rows.Scan(&c.ID, &price, &currency, &startsAt, &expirationDate, &c.Metadata); err != nil {
+			return nil, err
+		}
+		if !price.Valid {
+			c.Operation = models.OperationDelete
+		} else {
+			if c.Price, err = money.Parse(price.String); err != nil {
+				return nil, err
+			}
+			c.Currency = currency.String
+			if startsAt.Valid {
+				c.StartsAt = utc(&startsAt.Time)
+			}
+			c.ExpirationDate = expirationDate.Time.UTC()
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
+}
+
+func (r *WriteRepository) GetTotalPromotionsCount(ctx context.Context) (int, error) {
 	var count int
-	err := r.db.QueryRow("SELECT COUNT(*) FROM promotions").Scan(&count)
+	err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM promotions").Scan(&count)
 	return count, err
 }
 
-func (r *WriteRepository) GetPromotionsBatch(offset, limit int) ([]*models.Promotion, error) {
-	rows, err := r.db.Query("SELECT id, price, expiration_date FROM promotions LIMIT $1 OFFSET $2", limit, offset)
+func (r *WriteRepository) GetPromotionsBatch(ctx context.Context, offset, limit int) ([]*models.Promotion, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+promotionColumns+" FROM promotions LIMIT $1 OFFSET $2", limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -45,8 +719,7 @@ func (r *WriteRepository) GetPromotionsBatch(offset, limit int) ([]*models.Promo
 
 	var promotions []*models.Promotion
 	for rows.Next() {
-		p := &models.Promotion{}
-		err := rows.Scan(&p.ID, &p.Price, &p.ExpirationDate)
+		p, err := scanPromotion(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -54,4 +727,13 @@ func (r *WriteRepository) GetPromotionsBatch(offset, limit int) ([]*models.Promo
 	}
 
 	return promotions, rows.Err()
-}
\ No newline at end of file
+}
+
+// utc returns an optional time in UTC.
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
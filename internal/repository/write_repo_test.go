@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/sh3ll3y/promotion-service/internal/models"
+)
+
+// TestStagedLine checks that the rows of a split load are staged in the order
+// of the file, although each range counts its lines from its own start.
+func TestStagedLine(t *testing.T) {
+	type row struct {
+		line       int
+		checkpoint *models.Checkpoint
+		want       int
+	}
+	inRange := func(index int) *models.Checkpoint {
+		return &models.Checkpoint{Range: &models.ByteRange{Index: index}}
+	}
+	rows := []row{
+		{line: 1, checkpoint: inRange(2), want: 5},
+		{line: 70000, checkpoint: inRange(0), want: 2},
+		{line: 2, checkpoint: inRange(0), want: 1},
+		{line: 1, checkpoint: inRange(1), want: 3},
+		{line: 1 << 20, checkpoint: inRange(1), want: 4},
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return stagedLine(rows[i].line, rows[i].checkpoint) < stagedLine(rows[j].line, rows[j].checkpoint)
+	})
+	for i, r := range rows {
+		if r.want != i+1 {
+			t.Errorf("row %d is line %d of range %d, want row %d", i+1, r.line, r.checkpoint.Range.Index, r.want)
+		}
+	}
+
+	if got := stagedLine(42, &models.Checkpoint{}); got != 42 {
+		t.Errorf("stagedLine() of a sequential load = %d, want 42", got)
+	}
+}
+
+// TestDuplicateOrder checks that every duplicate policy orders the rows of an
+// ID, breaking ties by the staged line, so that the row kept does not depend
+// on the order the rows were written in.
+func TestDuplicateOrder(t *testing.T) {
+	tests := []struct {
+		policy models.DuplicatePolicy
+		want   string
+	}{
+		{policy: models.DuplicateReject, want: "line"},
+		{policy: models.DuplicateFirst, want: "line"},
+		{policy: models.DuplicateLast, want: "line DESC"},
+		{policy: models.DuplicateLowestPrice, want: "price, line"},
+	}
+	if len(duplicateOrder) != len(tests) {
+		t.Errorf("duplicateOrder has %d policies, want %d", len(duplicateOrder), len(tests))
+	}
+	for _, tt := range tests {
+		order, ok := duplicateOrder[tt.policy]
+		if !ok {
+			t.Errorf("no order for policy %s", tt.policy)
+			continue
+		}
+		if order != tt.want {
+			t.Errorf("order of policy %s = %q, want %q", tt.policy, order, tt.want)
+		}
+	}
+}
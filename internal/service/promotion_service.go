@@ -1,60 +1,362 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"github.com/sh3ll3y/promotion-service/internal/csv"
+	"github.com/sh3ll3y/promotion-service/internal/currency"
 	"github.com/sh3ll3y/promotion-service/internal/logging"
+	"github.com/sh3ll3y/promotion-service/internal/metrics"
 	"github.com/sh3ll3y/promotion-service/internal/models"
 	"github.com/sh3ll3y/promotion-service/internal/repository"
+	"github.com/sh3ll3y/promotion-service/internal/source"
 	"github.com/sh3ll3y/promotion-service/internal/types"
 	"go.uber.org/zap"
+	"io"
+	"strings"
 	"sync"
 )
 
 type PromotionService struct {
-	writeRepo     *repository.WriteRepository
-	readRepo      *repository.ReadRepository
+	writeRepo      *repository.WriteRepository
+	readRepo       *repository.ReadRepository
 	eventPublisher types.EventPublisher
+	ingestOptions  csv.Options
+	profiles       map[string]csv.Profile
+	defaultProfile string
+	sources        *source.Resolver
+	rates          *currency.Table
 }
 
-func NewPromotionService(writeRepo *repository.WriteRepository, readRepo *repository.ReadRepository, eventPublisher types.EventPublisher) *PromotionService {
+func NewPromotionService(writeRepo *repository.WriteRepository, readRepo *repository.ReadRepository, eventPublisher types.EventPublisher, ingestOptions csv.Options, profiles map[string]csv.Profile, defaultProfile string, sources *source.Resolver, rates *currency.Table) *PromotionService {
 	return &PromotionService{
-		writeRepo:     writeRepo,
-		readRepo:      readRepo,
+		writeRepo:      writeRepo,
+		readRepo:       readRepo,
 		eventPublisher: eventPublisher,
+		ingestOptions:  ingestOptions,
+		profiles:       profiles,
+		defaultProfile: defaultProfile,
+		sources:        sources,
+		rates:          rates,
 	}
 }
 
-func (s *PromotionService) ProcessCSVFile(filename string) error {
-	logging.Logger.Info("Starting CSV processing", zap.String("filename", filename))
+// Source resolves the source URI of a job: a local path, or a file://,
+// s3://, http:// or https:// URL.
+func (s *PromotionService) Source(uri string) (source.Source, error) {
+	return s.sources.Resolve(uri)
+}
+
+// ProfileName resolves the name of a CSV profile. Names are case-insensitive
+// and an empty name selects the default profile.
+func (s *PromotionService) ProfileName(name string) (string, error) {
+	if name == "" {
+		return s.defaultProfile, nil
+	}
+	name = strings.ToLower(name)
+	if _, ok := s.profiles[name]; !ok {
+		return "", fmt.Errorf("%w %q", csv.ErrUnknownProfile, name)
+	}
+	return name, nil
+}
+
+// Checkpoint returns the checkpoint an interrupted job can resume from, or
+// nil if it has none or its file has changed since, or may have.
+func (s *PromotionService) Checkpoint(ctx context.Context, job *models.Job) (*models.Checkpoint, error) {
+	checkpoint, err := s.writeRepo.GetCheckpoint(ctx, job.ID)
+	if err != nil || checkpoint == nil {
+		return nil, err
+	}
+
+	src, err := s.Source(job.Source)
+	if err != nil {
+		return nil, err
+	}
+	// A file that cannot be fingerprinted cannot be told apart from a changed one
+	fingerprint, err := csv.Fingerprint(ctx, src)
+	if err != nil {
+		logging.Logger.Warn("Failed to fingerprint file, starting over", zap.String("job_id", job.ID), zap.Error(err))
+		return nil, nil
+	}
+	if checkpoint.Fingerprint == "" || fingerprint != checkpoint.Fingerprint {
+		logging.Logger.Warn("File changed since checkpoint, starting over", zap.String("job_id", job.ID))
+		return nil, nil
+	}
+	return checkpoint, nil
+}
+
+// ProcessCSVFile loads the file of an ingestion job, using the job's profile,
+// format and load mode. With a checkpoint it continues the staged load the
+// checkpoint belongs to.
+func (s *PromotionService) ProcessCSVFile(ctx context.Context, job *models.Job, checkpoint *models.Checkpoint, stats *csv.Stats, rejects *csv.RejectReport) error {
+	logging.Logger.Info("Starting CSV processing", zap.String("filename", job.Source), zap.String("profile", job.Profile),
+		zap.String("format", job.Format), zap.String("mode", job.Mode))
+
+	opts, err := s.jobOptions(job)
+	if err != nil {
+		return err
+	}
+	src, err := s.Source(job.Source)
+	if err != nil {
+		return err
+	}
+	mode := opts.Mode
+	opts.Rejects = rejects
+	opts.Resume = checkpoint
+	if checkpoint != nil {
+		logging.Logger.Info("Resuming from checkpoint", zap.String("job_id", job.ID),
+			zap.Int64("offset", checkpoint.Offset), zap.Int("line", checkpoint.Line))
+	}
+
+	// Uploads are hashed as they are spooled, so an unchanged one is not
+	// loaded at all. Other sources are hashed as they are loaded.
+	if job.Spooled && job.SHA256 != "" && checkpoint == nil {
+		current, err := s.UnchangedDataset(ctx, job)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			logging.Logger.Info("File is identical to the current dataset, skipping load",
+				zap.String("job_id", job.ID), zap.String("dataset_id", current.ID))
+			job.DatasetID = current.ID
+			job.Unchanged = true
+			return nil
+		}
+	}
+	datasetSource := job.Source
+	// Spool files are removed once the job finishes
+	if job.Spooled {
+		datasetSource = "upload"
+	}
+	dataset := &models.Dataset{JobID: job.ID, Source: datasetSource, SHA256: job.SHA256, Profile: job.Profile, Format: job.Format, Mode: string(mode)}
+
+	// A file that cannot be fingerprinted, say because its server rejects
+	// HEAD requests, is still loaded, but its checkpoints cannot be resumed
+	fingerprint, err := csv.Fingerprint(ctx, src)
+	if err != nil {
+		logging.Logger.Warn("Failed to fingerprint file, the load cannot be resumed", zap.String("job_id", job.ID), zap.Error(err))
+		fingerprint = ""
+	}
+	// Tag every checkpoint with the job and its file
+	stage := func(write csv.PromotionSink) csv.PromotionSink {
+		return func(ctx context.Context, batch []*models.PromotionRecord, cp *models.Checkpoint) error {
+			cp.JobID = job.ID
+			cp.Fingerprint = fingerprint
+			return write(ctx, batch, cp)
+		}
+	}
+
+	if mode == csv.DeltaLoad {
+		err = s.stageDelta(ctx, src, stage(s.writeRepo.StageChanges), stats, opts, dataset)
+	} else {
+		err = s.stageFull(ctx, src, stage(s.writeRepo.StagePromotions), stats, opts, dataset)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The staged load is dropped rather than published if the file turns out
+	// to be identical to the current dataset
+	if checksum := stats.Checksum(); !job.Spooled && checksum != "" {
+		job.SHA256 = checksum
+		dataset.SHA256 = checksum
+		current, err := s.UnchangedDataset(ctx, job)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			logging.Logger.Info("File is identical to the current dataset, dropping staged load",
+				zap.String("job_id", job.ID), zap.String("dataset_id", current.ID))
+			if err := s.DiscardStagedLoad(ctx, job); err != nil {
+				return err
+			}
+			job.DatasetID = current.ID
+			job.Unchanged = true
+			return nil
+		}
+	}
+
+	if mode == csv.DeltaLoad {
+		err = s.publishDelta(ctx, stats, dataset)
+	} else {
+		err = s.publishFull(ctx, stats, opts, dataset)
+	}
+	if err != nil {
+		return err
+	}
+	job.DatasetID = dataset.ID
+
+	logging.Logger.Info("CSV processing completed successfully")
+	return nil
+}
+
+// DiscardStagedLoad drops what a cancelled or failed job has staged, along
+// with its checkpoint, so that it cannot be resumed. The published dataset
+// is not affected.
+func (s *PromotionService) DiscardStagedLoad(ctx context.Context, job *models.Job) error {
+	mode, err := csv.ParseLoadMode(job.Mode)
+	if err != nil {
+		return err
+	}
+	if mode == csv.DeltaLoad {
+		return s.writeRepo.ClearStagedChanges(ctx, job.ID)
+	}
+	return s.writeRepo.ClearStagingTable(ctx, job.ID)
+}
+
+// UnchangedDataset returns the published dataset if it was loaded from the
+// same content as the job's file, with the same profile, format and mode, or
+// nil if it was not. A dataset that has been loaded but not published yet
+// does not count, so a file is never skipped for a load that may still fail.
+func (s *PromotionService) UnchangedDataset(ctx context.Context, job *models.Job) (*models.Dataset, error) {
+	current, err := s.writeRepo.PublishedDataset(ctx)
+	if err != nil || current == nil {
+		return nil, err
+	}
+	mode, err := csv.ParseLoadMode(job.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if current.SHA256 != job.SHA256 || current.Profile != job.Profile || current.Format != job.Format || current.Mode != string(mode) {
+		return nil, nil
+	}
+	return current, nil
+}
+
+// ValidateFile parses the file of a job the way the job would load it,
+// without writing anything or publishing events.
+func (s *PromotionService) ValidateFile(ctx context.Context, job *models.Job, maxErrors int) (*csv.ValidationSummary, error) {
+	opts, err := s.jobOptions(job)
+	if err != nil {
+		return nil, err
+	}
+	src, err := s.Source(job.Source)
+	if err != nil {
+		return nil, err
+	}
+	return csv.ValidatePromotionsFromCSV(ctx, src, opts, maxErrors)
+}
+
+// ValidateUpload is ValidateFile for an upload that is read from r rather than
+// spooled. name is used to detect its compression.
+func (s *PromotionService) ValidateUpload(ctx context.Context, job *models.Job, r io.Reader, name string, maxErrors int) (*csv.ValidationSummary, error) {
+	opts, err := s.jobOptions(job)
+	if err != nil {
+		return nil, err
+	}
+	return csv.ValidatePromotionsFromReader(ctx, r, name, opts, maxErrors)
+}
 
-	// Clear write DB
-	err := s.writeRepo.ClearAllPromotions()
+func (s *PromotionService) jobOptions(job *models.Job) (csv.Options, error) {
+	profileName, err := s.ProfileName(job.Profile)
+	if err != nil {
+		return csv.Options{}, err
+	}
+	mode, err := csv.ParseLoadMode(job.Mode)
 	if err != nil {
-		return fmt.Errorf("failed to clear promotions in write DB: %w", err)
+		return csv.Options{}, err
+	}
+
+	opts := s.ingestOptions
+	opts.Profile = s.profiles[profileName]
+	opts.Format = csv.Format(job.Format)
+	opts.Mode = mode
+	return opts, nil
+}
+
+func (s *PromotionService) stageFull(ctx context.Context, src source.Source, sink csv.PromotionSink, stats *csv.Stats, opts csv.Options, dataset *models.Dataset) error {
+	// Load into the staging table, so the current dataset stays intact until
+	// the whole file has been accepted. A resumed load keeps what it staged.
+	if opts.Resume == nil {
+		err := s.writeRepo.ClearStagingTable(ctx, dataset.JobID)
+		if err != nil {
+			return fmt.Errorf("failed to clear staging table in write DB: %w", err)
+		}
 	}
 
 	// Read and process CSV
-	err = csv.ProcessPromotionsFromCSV(filename, s.writeRepo.CreatePromotion, 5, s.eventPublisher)
+	err := csv.ProcessPromotionsFromCSV(ctx, src, sink, stats, opts)
 	if err != nil {
 		return fmt.Errorf("failed to process CSV: %w", err)
 	}
+	return nil
+}
 
-	logging.Logger.Info("CSV processing completed successfully")
+func (s *PromotionService) publishFull(ctx context.Context, stats *csv.Stats, opts csv.Options, dataset *models.Dataset) error {
+	// Resolve repeated IDs and swap the staged load in
+	duplicates, err := s.writeRepo.PublishStagedPromotions(ctx, opts.DuplicatePolicy, dataset)
+	s.countDuplicates(stats, csv.FullLoad, opts.DuplicatePolicy, duplicates)
+	if err != nil {
+		return fmt.Errorf("failed to publish staged promotions: %w", err)
+	}
+
+	// Publish event after successful processing
+	err = s.eventPublisher.PublishNewFileLoadedEvent(dataset.ID)
+	if err != nil {
+		logging.Logger.Error("Failed to publish new file loaded event", zap.Error(err))
+		return fmt.Errorf("failed to publish new file loaded event: %w", err)
+	}
+	return nil
+}
+
+// stageDelta stages the upserts and deletes of a delta file, which
+// publishDelta applies in one transaction once the whole file has been
+// accepted.
+func (s *PromotionService) stageDelta(ctx context.Context, src source.Source, sink csv.PromotionSink, stats *csv.Stats, opts csv.Options, dataset *models.Dataset) error {
+	if opts.Resume == nil {
+		err := s.writeRepo.ClearStagedChanges(ctx, dataset.JobID)
+		if err != nil {
+			return fmt.Errorf("failed to clear staged changes in write DB: %w", err)
+		}
+	}
+
+	err := csv.ProcessPromotionsFromCSV(ctx, src, sink, stats, opts)
+	if err != nil {
+		return fmt.Errorf("failed to process CSV: %w", err)
+	}
+	return nil
+}
+
+func (s *PromotionService) publishDelta(ctx context.Context, stats *csv.Stats, dataset *models.Dataset) error {
+	changeSet, duplicates, err := s.writeRepo.ApplyStagedChanges(ctx, dataset)
+	if err != nil {
+		return fmt.Errorf("failed to apply staged changes: %w", err)
+	}
+	s.countDuplicates(stats, csv.DeltaLoad, models.DuplicateLast, duplicates)
+
+	err = s.eventPublisher.PublishPromotionsChangedEvent(changeSet, dataset.ID)
+	if err != nil {
+		logging.Logger.Error("Failed to publish promotions changed event", zap.Error(err), zap.String("change_set", changeSet))
+		return fmt.Errorf("failed to publish promotions changed event: %w", err)
+	}
 	return nil
 }
 
-func (s *PromotionService) UpdateReadDB() error {
+func (s *PromotionService) countDuplicates(stats *csv.Stats, mode csv.LoadMode, policy models.DuplicatePolicy, duplicates int64) {
+	if duplicates == 0 {
+		return
+	}
+	stats.Duplicates.Store(duplicates)
+	metrics.DuplicateIDs.WithLabelValues(string(mode), string(policy)).Add(float64(duplicates))
+	logging.Logger.Info("Found duplicate IDs", zap.Int64("duplicates", duplicates), zap.String("policy", string(policy)))
+}
+
+// UpdateReadDB rebuilds the read DB from the write DB and publishes the
+// dataset it was loaded from.
+func (s *PromotionService) UpdateReadDB(ctx context.Context, datasetID string) error {
+	if s.readSynced(ctx, datasetID) {
+		return nil
+	}
 	logging.Logger.Info("Starting read DB update")
 
 	// Clear temp table
-	err := s.readRepo.ClearTempTable()
+	err := s.readRepo.ClearTempTable(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to clear temp table: %w", err)
 	}
 
 	// Get total count
-	totalCount, err := s.writeRepo.GetTotalPromotionsCount()
+	totalCount, err := s.writeRepo.GetTotalPromotionsCount(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get total promotions count: %w", err)
 	}
@@ -70,7 +372,7 @@ func (s *PromotionService) UpdateReadDB() error {
 		go func(workerID int) {
 			defer wg.Done()
 			for offset := workerID * batchSize; offset < totalCount; offset += workerCount * batchSize {
-				err := s.processPromotionsBatch(offset, batchSize)
+				err := s.processPromotionsBatch(ctx, offset, batchSize)
 				if err != nil {
 					errChan <- err
 					return
@@ -88,23 +390,120 @@ func (s *PromotionService) UpdateReadDB() error {
 		}
 	}
 
-	// Swap tables
-	err = s.readRepo.SwapTables()
+	// Swap tables, recording the dataset they hold
+	err = s.readRepo.SwapTables(ctx, datasetID)
 	if err != nil {
 		return fmt.Errorf("failed to swap tables: %w", err)
 	}
+	s.markPublished(ctx, datasetID)
 
 	logging.Logger.Info("Read DB update completed successfully")
 	return nil
 }
 
-func (s *PromotionService) processPromotionsBatch(offset, limit int) error {
-	promotions, err := s.writeRepo.GetPromotionsBatch(offset, limit)
+// ApplyChangesToReadDB copies the promotions changed by a delta load to the
+// read DB, without rebuilding the whole table, and publishes the dataset.
+func (s *PromotionService) ApplyChangesToReadDB(ctx context.Context, changeSet, datasetID string) error {
+	if s.readSynced(ctx, datasetID) {
+		return nil
+	}
+	logging.Logger.Info("Starting read DB change update", zap.String("change_set", changeSet))
+
+	batchSize := 1000
+	applied := 0
+	for offset := 0; ; offset += batchSize {
+		changes, err := s.writeRepo.GetChangedPromotionsBatch(ctx, changeSet, offset, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to get changed promotions batch: %w", err)
+		}
+		if len(changes) == 0 {
+			break
+		}
+
+		var upserts []*models.Promotion
+		var deletes []string
+		for _, c := range changes {
+			if c.Operation == models.OperationDelete {
+				deletes = append(deletes, c.ID)
+			} else {
+				upserts = append(upserts, &c.Promotion)
+			}
+		}
+
+		err = s.readRepo.ApplyChanges(ctx, upserts, deletes)
+		if err != nil {
+			return fmt.Errorf("failed to apply changes batch: %w", err)
+		}
+		applied += len(changes)
+	}
+	s.publishDataset(ctx, datasetID)
+
+	logging.Logger.Info("Read DB change update completed successfully", zap.String("change_set", changeSet), zap.Int("promotions", applied))
+	return nil
+}
+
+// readSynced reports whether the read side has published a dataset already,
+// or a later full dataset superseded it. Every instance receives every event,
+// and the first one to take the load lock publishes it. If the status cannot
+// be read, the dataset is published again.
+func (s *PromotionService) readSynced(ctx context.Context, id string) bool {
+	status, err := s.writeRepo.GetDatasetStatus(ctx, id)
+	if err != nil {
+		logging.Logger.Error("Failed to get dataset status", zap.Error(err), zap.String("dataset_id", id))
+		return false
+	}
+	if status != models.DatasetLoaded {
+		logging.Logger.Info("Dataset already published", zap.String("dataset_id", id), zap.String("status", string(status)))
+		return true
+	}
+	return false
+}
+
+// publishDataset records that the read DB holds a dataset, both in the read
+// DB and in the catalog. The promotions are served already, so failures are
+// only logged.
+func (s *PromotionService) publishDataset(ctx context.Context, id string) {
+	if err := s.readRepo.SetDatasetVersion(ctx, id); err != nil {
+		logging.Logger.Error("Failed to record dataset version in read DB", zap.Error(err), zap.String("dataset_id", id))
+	}
+	s.markPublished(ctx, id)
+}
+
+// markPublished records in the catalog that the read DB holds a dataset.
+func (s *PromotionService) markPublished(ctx context.Context, id string) {
+	if err := s.writeRepo.MarkDatasetPublished(ctx, id); err != nil {
+		logging.Logger.Error("Failed to mark dataset published", zap.Error(err), zap.String("dataset_id", id))
+	}
+}
+
+// DatasetVersion returns the ID of the dataset the read DB holds, or an empty
+// string if it is not known.
+func (s *PromotionService) DatasetVersion(ctx context.Context) string {
+	version, err := s.readRepo.DatasetVersion(ctx)
+	if err != nil {
+		logging.Logger.Error("Failed to get dataset version", zap.Error(err))
+	}
+	return version
+}
+
+// ListDatasets returns the catalog of datasets, newest first.
+func (s *PromotionService) ListDatasets(ctx context.Context, status models.DatasetStatus, limit int) ([]*models.Dataset, error) {
+	return s.writeRepo.ListDatasets(ctx, status, limit)
+}
+
+// PublishedDataset returns the dataset that was published last, or nil if
+// nothing has been published.
+func (s *PromotionService) PublishedDataset(ctx context.Context) (*models.Dataset, error) {
+	return s.writeRepo.PublishedDataset(ctx)
+}
+
+func (s *PromotionService) processPromotionsBatch(ctx context.Context, offset, limit int) error {
+	promotions, err := s.writeRepo.GetPromotionsBatch(ctx, offset, limit)
 	if err != nil {
 		return fmt.Errorf("failed to get promotions batch: %w", err)
 	}
 
-	err = s.readRepo.BulkInsertPromotions(promotions)
+	err = s.readRepo.BulkInsertPromotions(ctx, promotions)
 	if err != nil {
 		return fmt.Errorf("failed to insert promotions batch: %w", err)
 	}
@@ -112,11 +511,26 @@ func (s *PromotionService) processPromotionsBatch(offset, limit int) error {
 	return nil
 }
 
-func (s *PromotionService) GetPromotion(id string) (*models.Promotion, error) {
-	promotion, err := s.readRepo.GetPromotion(id)
+func (s *PromotionService) GetPromotion(ctx context.Context, id string) (*models.Promotion, error) {
+	promotion, err := s.readRepo.GetPromotion(ctx, id)
 	if err != nil {
 		logging.Logger.Error("Failed to get promotion", zap.Error(err), zap.String("id", id))
 		return nil, err
 	}
 	return promotion, nil
-}
\ No newline at end of file
+}
+
+// ListPromotions returns a page of the promotions that match a filter.
+func (s *PromotionService) ListPromotions(ctx context.Context, filter repository.PromotionFilter) ([]*models.Promotion, error) {
+	return s.readRepo.ListPromotions(ctx, filter)
+}
+
+// ConvertPrice converts the price of a promotion into another currency with
+// the current exchange rates.
+func (s *PromotionService) ConvertPrice(promotion *models.Promotion, to string) (*currency.Conversion, error) {
+	rates, err := s.rates.Rates()
+	if err != nil {
+		return nil, err
+	}
+	return rates.Convert(promotion.Price, promotion.Currency, to)
+}
@@ -0,0 +1,37 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// fileSource is a file on the local file system.
+type fileSource string
+
+func (f fileSource) Open(_ context.Context, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(string(f))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to seek: %w", err)
+		}
+	}
+	return file, nil
+}
+
+func (f fileSource) Stat(context.Context) (Info, error) {
+	info, err := os.Stat(string(f))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size(), Ranges: true}, nil
+}
+
+func (f fileSource) Name() string {
+	return string(f)
+}
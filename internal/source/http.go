@@ -0,0 +1,105 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// httpSource is a file served over HTTP(S). Offsets are requested with a
+// Range header; servers that ignore it are read up to the offset.
+type httpSource struct {
+	client *http.Client
+	url    string
+	path   string
+}
+
+func (h *httpSource) Open(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	return openRange(h.client, req, offset)
+}
+
+func (h *httpSource) Stat(ctx context.Context) (Info, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.url, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	return stat(h.client, req)
+}
+
+func (h *httpSource) Name() string {
+	return h.path
+}
+
+// openRange sends a GET request for the content from offset on. An offset at
+// or past the end, which servers answer with 416 Range Not Satisfiable, gives
+// an empty content, as it does for local files.
+func openRange(client *http.Client, req *http.Request, offset int64) (io.ReadCloser, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && pastEnd(resp, offset):
+		resp.Body.Close()
+		return http.NoBody, nil
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			if _, err := io.CopyN(io.Discard, resp.Body, offset); err == io.EOF {
+				resp.Body.Close()
+				return http.NoBody, nil
+			} else if err != nil {
+				resp.Body.Close()
+				return nil, fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+			}
+		}
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// pastEnd tells whether a 416 response puts offset at or past the end of the
+// content. Without a Content-Range giving the size the server is trusted.
+func pastEnd(resp *http.Response, offset int64) bool {
+	total, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes */")
+	if !ok {
+		return true
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	return err != nil || offset >= size
+}
+
+// stat sends a HEAD request. The ETag, or failing that the modification
+// time, serves as the version. Without a Content-Length the size is -1.
+// Range requests are only relied on if the server advertises them with
+// Accept-Ranges, since a server that ignores them sends the whole content.
+func stat(client *http.Client, req *http.Request) (Info, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Info{}, responseError(resp)
+	}
+
+	version := resp.Header.Get("ETag")
+	if version == "" {
+		version = resp.Header.Get("Last-Modified")
+	}
+	ranges := strings.EqualFold(strings.TrimSpace(resp.Header.Get("Accept-Ranges")), "bytes")
+	return Info{Size: resp.ContentLength, Version: version, Ranges: ranges}, nil
+}
@@ -0,0 +1,112 @@
+package source
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSourceOpen(t *testing.T) {
+	const content = "id,price,expiration_date\n"
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "a.csv", time.Time{}, strings.NewReader(content))
+	}))
+	defer ranges.Close()
+	// A server that ignores Range headers
+	whole := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	}))
+	defer whole.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	size := int64(len(content))
+	tests := []struct {
+		name    string
+		url     string
+		offset  int64
+		want    string
+		wantErr bool
+	}{
+		{name: "start", url: ranges.URL, want: content},
+		{name: "range", url: ranges.URL, offset: 3, want: content[3:]},
+		{name: "last byte", url: ranges.URL, offset: size - 1, want: "\n"},
+		{name: "end", url: ranges.URL, offset: size},
+		{name: "past end", url: ranges.URL, offset: size + 10},
+		{name: "range ignored", url: whole.URL, offset: 3, want: content[3:]},
+		{name: "range ignored at end", url: whole.URL, offset: size},
+		{name: "range ignored past end", url: whole.URL, offset: size + 10},
+		{name: "not found", url: missing.URL, wantErr: true},
+		{name: "not found at offset", url: missing.URL, offset: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &httpSource{client: http.DefaultClient, url: tt.url + "/a.csv", path: "/a.csv"}
+			r, err := src.Open(context.Background(), tt.offset)
+			if tt.wantErr {
+				if err == nil {
+					r.Close()
+					t.Fatal("Open() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("content = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSourceStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    Info
+	}{
+		{
+			name: "size and etag",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Length", "42")
+				w.Header().Set("Accept-Ranges", "bytes")
+			},
+			want: Info{Size: 42, Version: `"v1"`, Ranges: true},
+		},
+		{
+			name: "empty",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "0")
+				w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			},
+			want: Info{Size: 0, Version: "Wed, 21 Oct 2015 07:28:00 GMT"},
+		},
+		{
+			name: "unknown size",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Transfer-Encoding", "chunked")
+				w.WriteHeader(http.StatusOK)
+			},
+			want: Info{Size: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			src := &httpSource{client: http.DefaultClient, url: server.URL, path: "/"}
+			got, err := src.Stat(context.Background())
+			if err != nil || got != tt.want {
+				t.Errorf("Stat() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
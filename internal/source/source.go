@@ -0,0 +1,133 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sh3ll3y/promotion-service/internal/config"
+)
+
+// Source is an input file, wherever it is stored.
+type Source interface {
+	// Open returns the content of the source from offset on, which is empty
+	// if offset is at or past the end. Cancelling ctx aborts reads from
+	// remote sources.
+	Open(ctx context.Context, offset int64) (io.ReadCloser, error)
+	// Stat returns the size of the source, or -1 if it is unknown, and a
+	// version that changes whenever its content does, if the store has one.
+	Stat(ctx context.Context) (Info, error)
+	// Name is the path of the source, from which its format and compression
+	// can be inferred.
+	Name() string
+}
+
+type Info struct {
+	Size    int64
+	Version string
+	// Ranges tells whether Open reads from an offset without reading what
+	// is before it. Only such sources are split into ranges.
+	Ranges bool
+}
+
+// maxRedirects is how many redirects an http source follows, as many as
+// net/http does by default.
+const maxRedirects = 10
+
+// Resolver turns the URIs of ingestion jobs into sources. A URI is a local
+// path, or a file://, s3://, http:// or https:// URL. http and https URLs,
+// and the redirects they lead to, must be on an allowed host.
+type Resolver struct {
+	s3           config.S3Config
+	allowedHosts []string
+	client       *http.Client
+	web          *http.Client
+}
+
+func NewResolver(sourcesCfg config.SourcesConfig, s3Cfg config.S3Config) *Resolver {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	r := &Resolver{s3: s3Cfg, allowedHosts: sourcesCfg.AllowedHosts, client: &http.Client{Transport: transport}}
+	r.web = &http.Client{Transport: transport, CheckRedirect: r.checkRedirect}
+	return r
+}
+
+// Resolve returns the source a URI refers to. It does not access the
+// source, so a source that does not exist is only reported when it is used.
+func (r *Resolver) Resolve(uri string) (Source, error) {
+	if !strings.Contains(uri, "://") {
+		return fileSource(uri), nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q: %w", uri, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("invalid source %q: file URLs must be local", uri)
+		}
+		return fileSource(u.Path), nil
+	case "s3":
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("invalid source %q: expected s3://bucket/key", uri)
+		}
+		return &s3Source{cfg: r.s3, client: r.client, bucket: u.Host, key: key}, nil
+	case "http", "https":
+		if !r.allowed(u.Hostname()) {
+			return nil, fmt.Errorf("invalid source %q: host %q is not allowed", uri, u.Hostname())
+		}
+		return &httpSource{client: r.web, url: u.String(), path: u.Path}, nil
+	}
+	return nil, fmt.Errorf("unsupported source scheme %q", u.Scheme)
+}
+
+func (r *Resolver) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after too many redirects")
+	}
+	if !r.allowed(req.URL.Hostname()) {
+		return fmt.Errorf("redirect to host %q is not allowed", req.URL.Hostname())
+	}
+	return nil
+}
+
+// allowed tells whether host matches one of the allowed hosts, ignoring case.
+// "*.example.com" matches the subdomains of example.com but not example.com.
+func (r *Resolver) allowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+	for _, pattern := range r.allowedHosts {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case pattern == host:
+			return true
+		}
+	}
+	return false
+}
+
+// responseError describes an unexpected HTTP response, including the start
+// of its body, which for S3 holds the error code.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if len(body) == 0 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return fmt.Errorf("unexpected response: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,108 @@
+package source
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sh3ll3y/promotion-service/internal/config"
+)
+
+func TestResolve(t *testing.T) {
+	allowed := config.SourcesConfig{AllowedHosts: []string{"files.example.com", "*.cdn.example.net", "10.0.0.5"}}
+	tests := []struct {
+		name    string
+		hosts   config.SourcesConfig
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{name: "path", uri: "/data/a.csv", want: "/data/a.csv"},
+		{name: "file url", uri: "file:///data/a.csv", want: "/data/a.csv"},
+		{name: "remote file url", uri: "file://host/data/a.csv", wantErr: true},
+		{name: "s3", uri: "s3://bucket/dir/a.csv", want: "dir/a.csv"},
+		{name: "s3 without key", uri: "s3://bucket", wantErr: true},
+		{name: "unknown scheme", uri: "ftp://files.example.com/a.csv", hosts: allowed, wantErr: true},
+		{name: "allowed host", uri: "https://files.example.com/a.csv", hosts: allowed, want: "/a.csv"},
+		{name: "allowed host with port", uri: "http://FILES.example.com:8080/a.csv", hosts: allowed, want: "/a.csv"},
+		{name: "allowed subdomain", uri: "https://eu.cdn.example.net/a.csv", hosts: allowed, want: "/a.csv"},
+		{name: "wildcard excludes apex", uri: "https://cdn.example.net/a.csv", hosts: allowed, wantErr: true},
+		{name: "suffix is not a subdomain", uri: "https://evilcdn.example.net/a.csv", hosts: allowed, wantErr: true},
+		{name: "allowed address", uri: "http://10.0.0.5/a.csv", hosts: allowed, want: "/a.csv"},
+		{name: "other address", uri: "http://169.254.169.254/latest/meta-data", hosts: allowed, wantErr: true},
+		{name: "other host", uri: "https://example.com/a.csv", hosts: allowed, wantErr: true},
+		{name: "no hosts", uri: "https://files.example.com/a.csv", wantErr: true},
+		{name: "any host", uri: "https://example.com/a.csv", hosts: config.SourcesConfig{AllowedHosts: []string{"*"}}, want: "/a.csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := NewResolver(tt.hosts, config.S3Config{}).Resolve(tt.uri)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Resolve(%q) = %s, want an error", tt.uri, src.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%q) error = %v", tt.uri, err)
+			}
+			if got := src.Name(); got != tt.want {
+				t.Errorf("Resolve(%q) = %s, want %s", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "content")
+	}))
+	defer target.Close()
+	// The target is reached as localhost, the redirecting server as 127.0.0.1
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, targetURL+"/a.csv", http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	tests := []struct {
+		name    string
+		hosts   []string
+		path    string
+		wantErr bool
+	}{
+		{name: "allowed", hosts: []string{"127.0.0.1", "localhost"}, path: "/a.csv"},
+		{name: "not allowed", hosts: []string{"127.0.0.1"}, path: "/a.csv", wantErr: true},
+		{name: "too many", hosts: []string{"127.0.0.1"}, path: "/loop", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := NewResolver(config.SourcesConfig{AllowedHosts: tt.hosts}, config.S3Config{}).Resolve(redirect.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := src.Open(context.Background(), 0)
+			if tt.wantErr {
+				if err == nil {
+					r.Close()
+					t.Fatal("Open() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if got, _ := io.ReadAll(r); string(got) != "content" {
+				t.Errorf("content = %q, want %q", got, "content")
+			}
+		})
+	}
+}
@@ -1,5 +1,6 @@
 package types
 
 type EventPublisher interface {
-	PublishNewFileLoadedEvent() error
-}
\ No newline at end of file
+	PublishNewFileLoadedEvent(datasetID string) error
+	PublishPromotionsChangedEvent(changeSet, datasetID string) error
+}
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE ingestion_jobs (
+                                id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                                state TEXT NOT NULL,
+                                source TEXT NOT NULL,
+                                spooled BOOLEAN NOT NULL DEFAULT FALSE,
+                                rows_read BIGINT NOT NULL DEFAULT 0,
+                                rows_written BIGINT NOT NULL DEFAULT 0,
+                                rows_rejected BIGINT NOT NULL DEFAULT 0,
+                                created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+                                started_at TIMESTAMPTZ,
+                                finished_at TIMESTAMPTZ,
+                                last_error TEXT
+);
+
+CREATE INDEX idx_ingestion_jobs_state_created_at ON ingestion_jobs(state, created_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS ingestion_jobs;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE ingestion_jobs ADD COLUMN reject_report TEXT;
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS reject_report;
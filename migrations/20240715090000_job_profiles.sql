@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE ingestion_jobs ADD COLUMN profile TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS profile;
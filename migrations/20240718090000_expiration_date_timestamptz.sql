@@ -0,0 +1,8 @@
+-- +goose Up
+-- Existing values were written without an offset and are taken to be UTC
+ALTER TABLE promotions ALTER COLUMN expiration_date TYPE TIMESTAMPTZ USING expiration_date AT TIME ZONE 'UTC';
+ALTER TABLE promotions_temp ALTER COLUMN expiration_date TYPE TIMESTAMPTZ USING expiration_date AT TIME ZONE 'UTC';
+
+-- +goose Down
+ALTER TABLE promotions ALTER COLUMN expiration_date TYPE TIMESTAMP USING expiration_date AT TIME ZONE 'UTC';
+ALTER TABLE promotions_temp ALTER COLUMN expiration_date TYPE TIMESTAMP USING expiration_date AT TIME ZONE 'UTC';
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE ingestion_jobs ADD COLUMN format TEXT NOT NULL DEFAULT 'csv';
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS format;
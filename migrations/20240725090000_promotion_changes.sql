@@ -0,0 +1,25 @@
+-- +goose Up
+-- Delta loads are copied into promotion_changes_staging and applied in one
+-- transaction; the IDs each load changed are logged in promotion_changes so
+-- that the read side can pull just those promotions, until it has published
+-- them. Staged rows belong to the job that staged them.
+CREATE TABLE promotion_changes_staging (
+                                           job_id UUID NOT NULL,
+                                           line BIGINT NOT NULL,
+                                           operation TEXT NOT NULL,
+                                           id UUID NOT NULL,
+                                           price DECIMAL(10, 2),
+                                           expiration_date TIMESTAMPTZ
+);
+
+CREATE INDEX idx_promotion_changes_staging_job_id ON promotion_changes_staging(job_id);
+
+CREATE TABLE promotion_changes (
+                                   change_set UUID NOT NULL,
+                                   id UUID NOT NULL,
+                                   PRIMARY KEY (change_set, id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS promotion_changes_staging;
+DROP TABLE IF EXISTS promotion_changes;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE ingestion_jobs ADD COLUMN mode TEXT NOT NULL DEFAULT 'full';
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS mode;
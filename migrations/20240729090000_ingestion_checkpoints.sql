@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE ingestion_checkpoints (
+    job_id UUID PRIMARY KEY REFERENCES ingestion_jobs (id) ON DELETE CASCADE,
+    fingerprint TEXT NOT NULL,
+    byte_offset BIGINT NOT NULL,
+    line INTEGER NOT NULL,
+    header TEXT[],
+    rows_read BIGINT NOT NULL,
+    rows_written BIGINT NOT NULL,
+    rows_rejected BIGINT NOT NULL,
+    reject_report_size BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE ingestion_jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS attempts;
+DROP TABLE IF EXISTS ingestion_checkpoints;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- Full loads are copied into promotions_staging, which allows repeated IDs,
+-- and deduplicated into promotions_temp when they are published. Staged rows
+-- belong to the job that staged them, like its checkpoint, so that clearing
+-- one job's load leaves the others resumable.
+CREATE TABLE promotions_staging (
+                                    job_id UUID NOT NULL,
+                                    line BIGINT NOT NULL,
+                                    id UUID NOT NULL,
+                                    price DECIMAL(10, 2) NOT NULL,
+                                    expiration_date TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_promotions_staging_job_id ON promotions_staging(job_id);
+
+ALTER TABLE ingestion_jobs ADD COLUMN duplicates BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS duplicates;
+DROP TABLE IF EXISTS promotions_staging;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE ingestion_jobs ADD COLUMN rule_violations JSONB;
+ALTER TABLE ingestion_checkpoints ADD COLUMN rule_violations JSONB;
+
+-- +goose Down
+ALTER TABLE ingestion_checkpoints DROP COLUMN IF EXISTS rule_violations;
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS rule_violations;
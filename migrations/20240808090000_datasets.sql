@@ -0,0 +1,28 @@
+-- +goose Up
+-- Every load that is published is recorded as a dataset, so that a file
+-- identical to the current one can be recognised by its SHA-256.
+CREATE TABLE datasets (
+                          id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                          job_id UUID NOT NULL,
+                          sha256 TEXT NOT NULL,
+                          profile TEXT NOT NULL,
+                          format TEXT NOT NULL,
+                          mode TEXT NOT NULL,
+                          rows BIGINT NOT NULL,
+                          change_set UUID,
+                          created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_datasets_created_at ON datasets(created_at);
+
+ALTER TABLE ingestion_jobs ADD COLUMN sha256 TEXT;
+ALTER TABLE ingestion_jobs ADD COLUMN idempotency_key TEXT UNIQUE;
+ALTER TABLE ingestion_jobs ADD COLUMN dataset_id UUID;
+ALTER TABLE ingestion_jobs ADD COLUMN unchanged BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS unchanged;
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS dataset_id;
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS idempotency_key;
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS sha256;
+DROP TABLE IF EXISTS datasets;
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE ingestion_range_checkpoints (
+    job_id UUID NOT NULL REFERENCES ingestion_checkpoints (job_id) ON DELETE CASCADE,
+    range_index INTEGER NOT NULL,
+    range_start BIGINT NOT NULL,
+    range_end BIGINT NOT NULL,
+    byte_offset BIGINT NOT NULL,
+    line INTEGER NOT NULL,
+    rows_read BIGINT NOT NULL,
+    rows_written BIGINT NOT NULL,
+    rows_rejected BIGINT NOT NULL,
+    reject_report_size BIGINT NOT NULL,
+    rule_violations JSONB,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (job_id, range_index)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS ingestion_range_checkpoints;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Existing prices are taken to be in the currency of the default profile
+ALTER TABLE promotions ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'EUR';
+ALTER TABLE promotions ALTER COLUMN currency DROP DEFAULT;
+ALTER TABLE promotions_temp ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'EUR';
+ALTER TABLE promotions_temp ALTER COLUMN currency DROP DEFAULT;
+ALTER TABLE promotions_staging ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'EUR';
+ALTER TABLE promotions_staging ALTER COLUMN currency DROP DEFAULT;
+-- Deletes have no currency
+ALTER TABLE promotion_changes_staging ADD COLUMN currency CHAR(3);
+
+-- +goose Down
+ALTER TABLE promotion_changes_staging DROP COLUMN IF EXISTS currency;
+ALTER TABLE promotions_staging DROP COLUMN IF EXISTS currency;
+ALTER TABLE promotions_temp DROP COLUMN IF EXISTS currency;
+ALTER TABLE promotions DROP COLUMN IF EXISTS currency;
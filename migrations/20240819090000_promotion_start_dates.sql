@@ -0,0 +1,12 @@
+-- +goose Up
+-- A promotion without a start date is valid right away
+ALTER TABLE promotions ADD COLUMN starts_at TIMESTAMPTZ;
+ALTER TABLE promotions_temp ADD COLUMN starts_at TIMESTAMPTZ;
+ALTER TABLE promotions_staging ADD COLUMN starts_at TIMESTAMPTZ;
+ALTER TABLE promotion_changes_staging ADD COLUMN starts_at TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE promotion_changes_staging DROP COLUMN IF EXISTS starts_at;
+ALTER TABLE promotions_staging DROP COLUMN IF EXISTS starts_at;
+ALTER TABLE promotions_temp DROP COLUMN IF EXISTS starts_at;
+ALTER TABLE promotions DROP COLUMN IF EXISTS starts_at;
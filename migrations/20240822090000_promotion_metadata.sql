@@ -0,0 +1,14 @@
+-- +goose Up
+-- Attributes such as SKU or channel, as an object of strings. Only the read
+-- database indexes them, see migrations/read.
+ALTER TABLE promotions ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE promotions_temp ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE promotions_staging ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+-- Deletes have no metadata
+ALTER TABLE promotion_changes_staging ADD COLUMN metadata JSONB;
+
+-- +goose Down
+ALTER TABLE promotion_changes_staging DROP COLUMN IF EXISTS metadata;
+ALTER TABLE promotions_staging DROP COLUMN IF EXISTS metadata;
+ALTER TABLE promotions_temp DROP COLUMN IF EXISTS metadata;
+ALTER TABLE promotions DROP COLUMN IF EXISTS metadata;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- Datasets are loaded into the write database and published once the read
+-- side has caught up with them. A delta dataset is applied on top of the full
+-- dataset named by base_id, and total_rows is how many promotions the dataset
+-- holds once it is applied, which for a full dataset is its row count.
+ALTER TABLE datasets RENAME COLUMN created_at TO loaded_at;
+ALTER TABLE datasets ADD COLUMN source TEXT NOT NULL;
+ALTER TABLE datasets ADD COLUMN status TEXT NOT NULL;
+ALTER TABLE datasets ADD COLUMN published_at TIMESTAMPTZ;
+ALTER TABLE datasets ADD COLUMN base_id UUID;
+ALTER TABLE datasets ADD COLUMN total_rows BIGINT NOT NULL;
+
+CREATE INDEX idx_datasets_published_at ON datasets(published_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_datasets_published_at;
+ALTER TABLE datasets DROP COLUMN IF EXISTS total_rows;
+ALTER TABLE datasets DROP COLUMN IF EXISTS base_id;
+ALTER TABLE datasets DROP COLUMN IF EXISTS published_at;
+ALTER TABLE datasets DROP COLUMN IF EXISTS status;
+ALTER TABLE datasets DROP COLUMN IF EXISTS source;
+ALTER TABLE datasets RENAME COLUMN loaded_at TO created_at;
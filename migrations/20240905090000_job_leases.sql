@@ -0,0 +1,13 @@
+-- +goose Up
+-- A running job is owned by the instance that claimed it, which renews its
+-- lease with a heartbeat from the moment it claims the job. Only jobs whose
+-- lease has expired are recovered.
+ALTER TABLE ingestion_jobs ADD COLUMN owner TEXT;
+ALTER TABLE ingestion_jobs ADD COLUMN heartbeat_at TIMESTAMPTZ;
+ALTER TABLE ingestion_jobs ADD CONSTRAINT ingestion_jobs_running_lease
+    CHECK (state <> 'running' OR (owner IS NOT NULL AND heartbeat_at IS NOT NULL));
+
+-- +goose Down
+ALTER TABLE ingestion_jobs DROP CONSTRAINT IF EXISTS ingestion_jobs_running_lease;
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS heartbeat_at;
+ALTER TABLE ingestion_jobs DROP COLUMN IF EXISTS owner;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- Metadata filters are containment queries (metadata @> '{"channel": "web"}'),
+-- which jsonb_path_ops indexes compactly. Both tables are indexed, since
+-- they are swapped on every full load.
+CREATE INDEX idx_promotions_metadata ON promotions USING GIN (metadata jsonb_path_ops);
+CREATE INDEX idx_promotions_temp_metadata ON promotions_temp USING GIN (metadata jsonb_path_ops);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_promotions_temp_metadata;
+DROP INDEX IF EXISTS idx_promotions_metadata;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- The dataset the read database holds, which promotion responses name in
+-- X-Dataset-Version. Promotions are cached in Redis under the generation of
+-- the promotions table, which every swap replaces, so entries cached from the
+-- old table are never read again. The table has a single row.
+CREATE TABLE published_dataset (
+                                   singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+                                   dataset_id UUID NOT NULL,
+                                   published_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+                                   cache_generation UUID NOT NULL DEFAULT gen_random_uuid()
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS published_dataset;